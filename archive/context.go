@@ -0,0 +1,26 @@
+package archive
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader stops reading from r once the context is done, returning its error, so that a big file doesn't delay an interruption
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil { // It can never be canceled
+		return r
+	}
+	return &contextReader{ctx, r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,185 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	CHANGE_ADDED    = "added"    // Only in the new snapshot
+	CHANGE_REMOVED  = "removed"  // Only in the old snapshot
+	CHANGE_MODIFIED = "modified" // In both, but different
+)
+
+type Change struct {
+	Name    string   `json:"path"`
+	Kind    string   `json:"change"`
+	Reasons []string `json:"reasons,omitempty"` // What is different: type, size, mode, mtime and/or content
+}
+
+// Snapshot is a set of entries, either from an archive or from the disk, that can be compared
+type Snapshot struct {
+	Entries map[string]IndexEntry
+	paths   map[string]string // Where the entries are on disk, so that they are only hashed if needed
+}
+
+// NewSnapshot uses the entries of an index, which already contain the hashes
+func NewSnapshot(entries []IndexEntry, filter *Filter) *Snapshot {
+	snapshot := &Snapshot{Entries: map[string]IndexEntry{}}
+	for _, entry := range entries {
+		if filter.Match(entry.Name) {
+			snapshot.Entries[entry.Name] = entry
+		}
+	}
+	return snapshot
+}
+
+// ReadSnapshot reads the whole archive, hashing the content of every file
+func ReadSnapshot(in io.Reader, filter *Filter) (*Snapshot, error) {
+	snapshot := &Snapshot{Entries: map[string]IndexEntry{}}
+	tarReader := tar.NewReader(in)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !filter.Match(header.Name) {
+			continue
+		}
+
+		entry := IndexEntry{Entry: entryFromHeader(header)}
+		if !entry.IsDir {
+			hash := blake3.New(HASH_SIZE, nil)
+			if _, err := io.Copy(hash, tarReader); err != nil {
+				return nil, err
+			}
+			entry.Hash = hash.Sum(nil)
+		}
+		snapshot.Entries[entry.Name] = entry
+	}
+	return snapshot, nil
+}
+
+// ScanSnapshot walks the paths the same way Tar does. Files are hashed later, only if needed
+func ScanSnapshot(paths []string, filter *Filter) (*Snapshot, error) {
+	snapshot := &Snapshot{Entries: map[string]IndexEntry{}, paths: map[string]string{}}
+
+	err := walk(paths, func(w walkEntry) error {
+		name := cleanName(w.Name)
+		if !filter.Match(name) {
+			return nil
+		}
+
+		entry := Entry{
+			Name:    name,
+			Size:    w.Info.Size(),
+			Mode:    w.Info.Mode(),
+			ModTime: w.Info.ModTime(),
+			IsDir:   w.Info.IsDir(),
+		}
+		if entry.IsDir {
+			entry.Size = 0
+		}
+		snapshot.Entries[name] = IndexEntry{Entry: entry}
+		snapshot.paths[name] = w.Path
+		return nil
+	})
+	return snapshot, err
+}
+
+func (s *Snapshot) hash(entry IndexEntry) ([]byte, error) {
+	path, ok := s.paths[entry.Name]
+	if entry.Hash != nil || entry.IsDir || !ok {
+		return entry.Hash, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := blake3.New(HASH_SIZE, nil)
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// Diff returns what changed from the snapshot before to the one after, sorted by path
+func Diff(before, after *Snapshot) ([]Change, error) {
+	changes := []Change{}
+
+	for name, beforeEntry := range before.Entries {
+		afterEntry, ok := after.Entries[name]
+		if !ok {
+			changes = append(changes, Change{Name: name, Kind: CHANGE_REMOVED})
+			continue
+		}
+
+		reasons, err := compare(before, beforeEntry, after, afterEntry)
+		if err != nil {
+			return nil, err
+		}
+		if len(reasons) > 0 {
+			changes = append(changes, Change{Name: name, Kind: CHANGE_MODIFIED, Reasons: reasons})
+		}
+	}
+
+	for name := range after.Entries {
+		if _, ok := before.Entries[name]; !ok {
+			changes = append(changes, Change{Name: name, Kind: CHANGE_ADDED})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes, nil
+}
+
+func compare(before *Snapshot, beforeEntry IndexEntry, after *Snapshot, afterEntry IndexEntry) ([]string, error) {
+	if beforeEntry.IsDir != afterEntry.IsDir {
+		return []string{"type"}, nil
+	}
+
+	reasons := []string{}
+	if beforeEntry.Mode != afterEntry.Mode {
+		reasons = append(reasons, "mode")
+	}
+	if beforeEntry.IsDir { // The last modification of a folder changes with its content, no need to show it twice
+		return reasons, nil
+	}
+
+	if beforeEntry.Size != afterEntry.Size {
+		reasons = append(reasons, "size")
+	}
+	if !archiveTime(beforeEntry.ModTime).Equal(archiveTime(afterEntry.ModTime)) {
+		reasons = append(reasons, "mtime")
+	}
+
+	// Different sizes always mean different contents, no need to read them
+	if beforeEntry.Size == afterEntry.Size {
+		beforeHash, err := before.hash(beforeEntry)
+		if err != nil {
+			return nil, err
+		}
+		afterHash, err := after.hash(afterEntry)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(beforeHash, afterHash) {
+			reasons = append(reasons, "content")
+		}
+	}
+	return reasons, nil
+}
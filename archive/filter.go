@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"path"
+	"strings"
+)
+
+// Filter selects which entries of an archive get processed.
+// A nil or empty filter matches every entry
+type Filter struct {
+	Include []string // Glob patterns of the entries to keep (all of them if empty)
+	Exclude []string // Glob patterns of the entries to skip, even if included
+}
+
+func NewFilter(include, exclude []string) (*Filter, error) {
+	filter := &Filter{}
+	for _, pattern := range include {
+		filter.Include = append(filter.Include, cleanName(pattern))
+	}
+	for _, pattern := range exclude {
+		filter.Exclude = append(filter.Exclude, cleanName(pattern))
+	}
+
+	// Check the patterns now, instead of failing halfway through the archive
+	for _, pattern := range append(filter.Include, filter.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func (f *Filter) IsEmpty() bool {
+	return f == nil || (len(f.Include) == 0 && len(f.Exclude) == 0)
+}
+
+// Match reports whether the entry should be processed.
+// A pattern matching a folder also matches everything inside of it
+func (f *Filter) Match(name string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+
+	name = cleanName(name)
+	if len(f.Include) > 0 && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+// Archives created on windows use "\" as a separator
+func cleanName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return strings.Trim(name, "/")
+}
+
+func matchAny(patterns []string, name string) bool {
+	segments := strings.Split(name, "/")
+	for _, pattern := range patterns {
+		patternSegments := strings.Split(pattern, "/")
+
+		// Try the entry itself and every one of its parent folders
+		for i := 1; i <= len(segments); i++ {
+			if matchSegments(patternSegments, segments[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Same as path.Match, but "**" also matches any amount of folders
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,50 @@
+package archive
+
+import "testing"
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		include, exclude []string
+		name             string
+		match            bool
+	}{
+		{nil, nil, "anything/at/all", true},
+		{[]string{"docs"}, nil, "docs", true},
+		{[]string{"docs"}, nil, "docs/a/b.txt", true}, // Everything inside of a matched folder
+		{[]string{"docs"}, nil, "documents/a.txt", false},
+		{[]string{"docs/*.pdf"}, nil, "docs/a.pdf", true},
+		{[]string{"docs/*.pdf"}, nil, "docs/sub/a.pdf", false}, // * doesn't cross folders
+		{[]string{"docs/**/*.pdf"}, nil, "docs/a.pdf", true},   // ** also matches no folder at all
+		{[]string{"docs/**/*.pdf"}, nil, "docs/a/b/c.pdf", true},
+		{[]string{"docs/**/*.pdf"}, nil, "docs/a/b/c.txt", false},
+		{[]string{"**/*.go"}, nil, "main.go", true},
+		{[]string{"**/*.go"}, nil, "src/pkg/file.go", true},
+		{[]string{"**"}, nil, "src/pkg/file.go", true},
+		{[]string{"src/**/test"}, nil, "src/a/test/data.bin", true}, // Inside of a matched folder
+		{[]string{"/docs/"}, nil, "docs/a.txt", true},               // Leading and trailing separators are ignored
+		{[]string{"docs"}, nil, "docs\\a.txt", true},                // Archives created on windows
+		{[]string{"docs"}, []string{"docs/old"}, "docs/new/a.txt", true},
+		{[]string{"docs"}, []string{"docs/old"}, "docs/old/a.txt", false},
+		{nil, []string{"**/*.tmp"}, "a/b/c.tmp", false},
+		{nil, []string{"**/*.tmp"}, "a/b/c.txt", true},
+	}
+	for _, test := range tests {
+		filter, err := NewFilter(test.include, test.exclude)
+		if err != nil {
+			t.Fatalf("include %q, exclude %q: %v", test.include, test.exclude, err)
+		}
+		if match := filter.Match(test.name); match != test.match {
+			t.Errorf("include %q, exclude %q: %s matched %v, want %v", test.include, test.exclude, test.name, match, test.match)
+		}
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	if _, err := NewFilter([]string{"docs/[a-"}, nil); err == nil {
+		t.Fatal("an invalid pattern has been accepted")
+	}
+	var filter *Filter
+	if !filter.IsEmpty() || !filter.Match("a") {
+		t.Fatal("a nil filter doesn't match everything")
+	}
+}
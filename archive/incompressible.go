@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// SNIFF_SIZE is how much of each file is read to recognize its format
+const SNIFF_SIZE = 512
+
+// DEFAULT_INCOMPRESSIBLE are the extensions of the most common formats that are already compressed
+var DEFAULT_INCOMPRESSIBLE = []string{
+	"jpg", "jpeg", "png", "gif", "webp", "heic", "avif",
+	"mp4", "m4v", "mkv", "mov", "avi", "webm",
+	"mp3", "m4a", "aac", "ogg", "opus", "flac",
+	"zip", "jar", "apk", "gz", "tgz", "bz2", "xz", "zst", "lz4", "7z", "rar",
+	"docx", "xlsx", "pptx", "odt", "ods", "odp", "epub",
+}
+
+// Signatures of compressed formats, found at the start of the file
+var magicNumbers = [][]byte{
+	{0xFF, 0xD8, 0xFF},                 // jpeg
+	{0x89, 'P', 'N', 'G'},              // png
+	[]byte("GIF8"),                     // gif
+	[]byte("PK\x03\x04"),               // zip (jar, docx, ...)
+	{0x1F, 0x8B},                       // gzip
+	{0x28, 0xB5, 0x2F, 0xFD},           // zstd
+	{0xFD, '7', 'z', 'X', 'Z', 0x00},   // xz
+	[]byte("BZh"),                      // bzip2
+	{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, // 7z
+	[]byte("Rar!\x1A\x07"),             // rar
+	{0x04, 0x22, 0x4D, 0x18},           // lz4
+	{0x1A, 0x45, 0xDF, 0xA3},           // mkv, webm
+	[]byte("ID3"),                      // mp3
+	[]byte("fLaC"),                     // flac
+	[]byte("OggS"),                     // ogg, opus
+}
+
+// Incompressible recognizes files that are already compressed, which would only waste time if compressed again
+type Incompressible struct {
+	extensions map[string]bool
+}
+
+func NewIncompressible(extensions []string) *Incompressible {
+	i := &Incompressible{extensions: map[string]bool{}}
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			i.extensions[ext] = true
+		}
+	}
+	return i
+}
+
+// Match checks the extension of the file, and then its first bytes
+func (i *Incompressible) Match(name string, head []byte) bool {
+	if i == nil {
+		return false
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if i.extensions[ext] {
+		return true
+	}
+
+	for _, magic := range magicNumbers {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+
+	// mp4, mov and heic have the signature after the size of the first box
+	if len(head) >= 8 && string(head[4:8]) == "ftyp" {
+		return true
+	}
+	// webp and avi
+	if len(head) >= 12 && string(head[:4]) == "RIFF" && (string(head[8:12]) == "WEBP" || string(head[8:12]) == "AVI ") {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package archive
+
+import (
+	"io"
+	"time"
+)
+
+// Framer splits the archive in independent frames, so that every entry can later be read on its own.
+// Frames are either compressed by the workers with their own encoders and then appended,
+// or compressed while being written, for the entries that are too big to be kept in memory
+type Framer interface {
+	io.Writer                                    // Writes to the current (streamed) frame
+	NewFrame(store bool) (int, error)            // Ends the current frame, and returns the number of the one being started. store means its content is already compressed
+	NewEncoder(store bool) (FrameEncoder, error) // Returns an encoder for the workers. It must be safe to call concurrently
+	AppendFrame(frame CompressedFrame) (int, error)
+}
+
+// FrameEncoder compresses a single frame at a time, and can be reused for the next one
+type FrameEncoder interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// CompressedFrame is a frame compressed by one of the workers, ready to be appended
+type CompressedFrame struct {
+	Data  []byte
+	Store bool
+	In    int64         // Size before compression
+	Time  time.Duration // Spent compressing
+}
+
+// Frame is the position of an independent frame inside of the (compressed) archive
+type Frame struct {
+	Offset int64
+	Size   int64
+}
+
+type IndexEntry struct {
+	Entry
+	Frame int    // The frame the entry header starts at
+	Hash  []byte // Blake3 of the file content (empty for folders)
+}
+
+// Index describes the content of an archive, and where each entry can be found
+type Index struct {
+	Roots   map[string]string // The original location of each path that has been backed up
+	Frames  []Frame
+	Entries []IndexEntry
+}
+
+// EntrySpan returns the position of the i-th entry inside of the archive (from the start of its frame to the start of the next entry)
+func (idx *Index) EntrySpan(i int) (offset, size int64) {
+	frame := idx.Frames[idx.Entries[i].Frame]
+
+	next := idx.Frames[len(idx.Frames)-1] // The end of the archive
+	if i+1 < len(idx.Entries) {
+		next = idx.Frames[idx.Entries[i+1].Frame]
+	}
+	return frame.Offset, next.Offset - frame.Offset
+}
@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"time"
+)
+
+type Entry struct {
+	Name    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	IsDir   bool        `json:"dir"`
+}
+
+// archiveTime is the precision of the modification times in the archive, since the tar headers round them to the second.
+// The times in the indexes of older backups weren't rounded
+func archiveTime(t time.Time) time.Time {
+	return t.Round(time.Second)
+}
+
+// List reads every header of the archive, without writing anything to disk
+func List(in io.Reader, filter *Filter, fn func(Entry)) (files, folders uint64, err error) {
+	tarReader := tar.NewReader(in)
+	files, folders = 0, 0
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files, folders, err
+		}
+
+		if !filter.Match(header.Name) {
+			continue
+		}
+
+		entry := entryFromHeader(header)
+		if entry.IsDir {
+			folders++
+		} else {
+			files++
+		}
+		fn(entry)
+	}
+	return files, folders, nil
+}
@@ -0,0 +1,286 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+const DEFAULT_MEMORY_LIMIT = 256 << 20
+
+// Frames are compressed into a buffer sized in advance, a little bigger than the content in case it doesn't compress
+const frameOverhead = 16 << 10
+
+var errStopped = errors.New("the archive has been stopped")
+
+type TarOptions struct {
+	Incompressible *Incompressible
+	Workers        int          // Files read and compressed at the same time (the number of cpus if 0)
+	MemoryLimit    int64        // Max size of the frames waiting to be written (DEFAULT_MEMORY_LIMIT if 0). Bigger files are compressed while writing them, one at a time
+	Progress       ProgressFunc // Reports the progress, if set
+	Total          int64        // Bytes of the files to archive, for the progress (0 if unknown)
+	TotalEntries   uint64       // Files and folders to archive, for the progress (0 if unknown)
+}
+
+func (o TarOptions) workers() int {
+	if o.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.Workers
+}
+
+func (o TarOptions) memoryLimit() int64 {
+	if o.MemoryLimit <= 0 {
+		return DEFAULT_MEMORY_LIMIT
+	}
+	return o.MemoryLimit
+}
+
+// tarJob is an entry of the archive, waiting for its frame
+type tarJob struct {
+	walkEntry
+	header   *tar.Header
+	reserved int64 // Memory reserved for its frame
+	stream   bool  // Too big to be kept in memory, it's compressed by the writer instead
+	result   chan tarResult
+}
+
+type tarResult struct {
+	frame CompressedFrame
+	hash  []byte
+	err   error
+}
+
+// Budget limits the memory used by the frames that have been processed, but not consumed yet
+type Budget struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	free    int64
+	stopped bool
+}
+
+func NewBudget(size int64) *Budget {
+	b := &Budget{free: size}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Acquire waits until there is enough free memory. Returns false if the budget has been stopped in the meantime
+func (b *Budget) Acquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.free < n && !b.stopped {
+		b.cond.Wait()
+	}
+	if b.stopped {
+		return false
+	}
+	b.free -= n
+	return true
+}
+
+func (b *Budget) Release(n int64) {
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *Budget) Stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// pipeline walks the paths in order, while the workers compress the entries concurrently into independent frames.
+// The writer then appends them in the same order they were walked, so that the archive is always the same
+type pipeline struct {
+	ctx     context.Context
+	out     Framer
+	opts    TarOptions
+	budget  *Budget
+	queue   chan *tarJob // Every entry, in order, for the writer
+	jobs    chan *tarJob // The entries for the workers
+	stopped chan struct{}
+	stop    func()
+	walkErr error
+	wg      sync.WaitGroup
+}
+
+func newPipeline(ctx context.Context, paths []string, out Framer, opts TarOptions) *pipeline {
+	workers := opts.workers()
+	p := &pipeline{
+		ctx:     ctx,
+		out:     out,
+		opts:    opts,
+		budget:  NewBudget(opts.memoryLimit()),
+		queue:   make(chan *tarJob, 4*workers),
+		jobs:    make(chan *tarJob, workers),
+		stopped: make(chan struct{}),
+	}
+	p.stop = sync.OnceFunc(func() {
+		close(p.stopped)
+		p.budget.Stop()
+	})
+
+	p.wg.Add(1 + workers)
+	go p.produce(paths)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// produce walks the paths, and queues every entry
+func (p *pipeline) produce(paths []string) {
+	defer p.wg.Done()
+	defer close(p.jobs)
+	defer close(p.queue)
+
+	p.walkErr = walk(paths, func(w walkEntry) error {
+		header, err := tar.FileInfoHeader(w.Info, w.Info.Name())
+		if err != nil {
+			return err
+		}
+		header.Name = w.Name
+		if w.IsRoot {
+			header.PAXRecords = map[string]string{PAX_SOURCE: w.Source}
+		}
+
+		job := &tarJob{walkEntry: w, header: header, result: make(chan tarResult, 1)}
+		if !w.Info.IsDir() {
+			job.reserved = w.Info.Size()
+		}
+		job.reserved += job.reserved/64 + frameOverhead
+		job.stream = job.reserved > p.opts.memoryLimit()
+
+		// The memory is reserved in order, so that the entry the writer is waiting for always gets it first
+		if !job.stream && !p.budget.Acquire(job.reserved) {
+			return errStopped
+		}
+		select {
+		case p.queue <- job:
+		case <-p.stopped:
+			return errStopped
+		}
+		if !job.stream {
+			select {
+			case p.jobs <- job:
+			case <-p.stopped:
+				return errStopped
+			}
+		}
+		return nil
+	})
+}
+
+// work compresses the entries into memory, reusing its encoders
+func (p *pipeline) work() {
+	defer p.wg.Done()
+	var encoders [2]FrameEncoder // Normal and stored
+
+	for job := range p.jobs {
+		select {
+		case <-p.stopped:
+			job.result <- tarResult{err: errStopped}
+			continue
+		default:
+		}
+
+		var encoder FrameEncoder
+		buf := bytes.NewBuffer(make([]byte, 0, job.reserved))
+		timed := &timedWriter{}
+		frame := CompressedFrame{}
+
+		hash, err := archiveEntry(p.ctx, job, p.opts.Incompressible, func(store bool) (io.Writer, error) {
+			kind := 0
+			if store {
+				kind = 1
+			}
+			if encoders[kind] == nil {
+				var err error
+				if encoders[kind], err = p.out.NewEncoder(store); err != nil {
+					return nil, err
+				}
+			}
+			encoder = encoders[kind]
+			encoder.Reset(buf)
+			timed.w = encoder
+			frame.Store = store
+			return timed, nil
+		})
+		if err == nil {
+			startTime := time.Now()
+			err = encoder.Close()
+			timed.d += time.Since(startTime)
+		}
+
+		frame.Data, frame.In, frame.Time = buf.Bytes(), timed.n, timed.d
+		job.result <- tarResult{frame: frame, hash: hash, err: err}
+	}
+}
+
+// archiveEntry writes the tar entry of the job to the writer returned by start,
+// which is called once it's known whether the file is already compressed. Returns the hash of the content, or the error of the context once done
+func archiveEntry(ctx context.Context, job *tarJob, incompressible *Incompressible, start func(store bool) (io.Writer, error)) ([]byte, error) {
+
+	// Files are opened first, to check if they are already compressed
+	var file *os.File
+	var head []byte
+	if !job.Info.IsDir() {
+		var err error
+		if file, err = os.Open(job.Path); err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		head = make([]byte, SNIFF_SIZE)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		head = head[:n]
+	}
+
+	out, err := start(incompressible.Match(job.Name, head))
+	if err != nil {
+		return nil, err
+	}
+	tarWriter := tar.NewWriter(out) // Never closed, the end of the archive is written on its own
+	if err := tarWriter.WriteHeader(job.header); err != nil {
+		return nil, err
+	}
+	if job.Info.IsDir() {
+		return nil, tarWriter.Flush()
+	}
+
+	hash := blake3.New(HASH_SIZE, nil)
+	if _, err = io.Copy(io.MultiWriter(tarWriter, hash), ContextReader(ctx, io.MultiReader(bytes.NewReader(head), file))); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), tarWriter.Flush() // Padding
+}
+
+// timedWriter keeps track of how much has been written, and how long it took
+type timedWriter struct {
+	w io.Writer
+	n int64
+	d time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	startTime := time.Now()
+	n, err := t.w.Write(p)
+	t.n += int64(n)
+	t.d += time.Since(startTime)
+	return n, err
+}
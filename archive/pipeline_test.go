@@ -0,0 +1,38 @@
+package archive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	budget := NewBudget(100)
+	if !budget.Acquire(60) || !budget.Acquire(40) {
+		t.Fatal("the memory available hasn't been acquired")
+	}
+
+	// Waits until enough memory is released, not only part of it
+	acquired := make(chan bool)
+	go func() { acquired <- budget.Acquire(50) }()
+	budget.Release(40)
+	select {
+	case <-acquired:
+		t.Fatal("acquired 50 with only 40 free")
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.Release(60)
+	if ok := <-acquired; !ok {
+		t.Fatal("acquire failed once the memory has been released")
+	}
+
+	// Stopping wakes up every waiting acquire, and fails the next ones
+	go func() { acquired <- budget.Acquire(1000) }()
+	time.Sleep(10 * time.Millisecond)
+	budget.Stop()
+	if ok := <-acquired; ok {
+		t.Fatal("acquire succeeded after the budget has been stopped")
+	}
+	if budget.Acquire(1) {
+		t.Fatal("acquire succeeded after the budget has been stopped")
+	}
+}
@@ -0,0 +1,168 @@
+package archive
+
+import (
+	"io"
+	"time"
+)
+
+// REPORT_INTERVAL is the minimum time between two reports of the progress while copying an entry
+const REPORT_INTERVAL = 100 * time.Millisecond
+
+// Stage is the operation whose progress is reported
+type Stage string
+
+const (
+	STAGE_BACKUP  Stage = "backup"
+	STAGE_VERIFY  Stage = "verify"
+	STAGE_RESTORE Stage = "restore"
+)
+
+// Progress is the state of a backup, a verification or a restore. It's reported every time an entry is done,
+// and regularly while a big one is being copied, so that any front end can show it
+type Progress struct {
+	Stage        Stage
+	Bytes        int64  // Processed so far
+	Total        int64  // Expected in total, 0 if unknown
+	Entries      uint64 // Files and folders processed so far
+	TotalEntries uint64 // 0 if unknown
+	Current      string // The entry being processed
+	Line         string // What has been done with the entry just completed (ex. "+ [1.00 MB] a/b"), empty while copying it
+	Elapsed      time.Duration
+	Final        bool // The stage is over, no other report follows
+}
+
+// ProgressFunc receives the reports, from a single goroutine at a time
+type ProgressFunc func(Progress)
+
+// Throughput returns the bytes processed per second
+func (p Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA returns the time left, or -1 if it can't be known
+func (p Progress) ETA() time.Duration {
+	speed := p.Throughput()
+	if p.Total <= 0 || speed <= 0 {
+		return -1
+	}
+	return time.Duration(float64(max(p.Total-p.Bytes, 0)) / speed * float64(time.Second))
+}
+
+// Tracker keeps the progress up to date, and reports it. A nil Tracker, or one without a ProgressFunc, does nothing
+type Tracker struct {
+	report   ProgressFunc
+	state    Progress
+	start    time.Time
+	reported time.Time
+	size     int64 // Of the current entry
+	counted  int64 // Of the current entry, so far
+}
+
+// NewTracker starts tracking the stage, with the totals if known
+func NewTracker(stage Stage, total int64, totalEntries uint64, report ProgressFunc) *Tracker {
+	return &Tracker{
+		report: report,
+		state:  Progress{Stage: stage, Total: total, TotalEntries: totalEntries},
+		start:  time.Now(),
+	}
+}
+
+// SetTotal updates the totals, once they are known
+func (t *Tracker) SetTotal(total int64, totalEntries uint64) {
+	if t != nil {
+		t.state.Total, t.state.TotalEntries = total, totalEntries
+	}
+}
+
+func (t *Tracker) send(force bool) {
+	now := time.Now()
+	if !force && now.Sub(t.reported) < REPORT_INTERVAL {
+		return
+	}
+	t.reported = now
+	t.state.Elapsed = now.Sub(t.start)
+	t.report(t.state)
+	t.state.Line = ""
+}
+
+// Start reports that the entry is being processed, with the bytes it's expected to take
+func (t *Tracker) Start(name string, size int64) {
+	if t == nil || t.report == nil {
+		return
+	}
+	t.state.Current, t.size, t.counted = name, size, 0
+	t.send(false)
+}
+
+// Add counts the bytes of the current entry processed so far
+func (t *Tracker) Add(n int64) {
+	if t == nil || t.report == nil {
+		return
+	}
+	t.state.Bytes += n
+	t.counted += n
+	t.send(false)
+}
+
+// Done reports that the current entry is complete, counting what's left of its size even if it has been skipped
+func (t *Tracker) Done(line string) {
+	if t == nil || t.report == nil {
+		return
+	}
+	t.state.Bytes += max(t.size-t.counted, 0)
+	t.size, t.counted = 0, 0
+	t.state.Entries++
+	t.state.Line = line
+	t.send(true)
+}
+
+// Finish sends the last report
+func (t *Tracker) Finish() {
+	if t == nil || t.report == nil {
+		return
+	}
+	t.state.Current = ""
+	t.state.Final = true
+	t.send(true)
+}
+
+// Reader counts what's read from r as part of the current entry
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	if t == nil || t.report == nil {
+		return r
+	}
+	return &trackedReader{r, t}
+}
+
+// Writer counts what's written to w as part of the current entry
+func (t *Tracker) Writer(w io.Writer) io.Writer {
+	if t == nil || t.report == nil {
+		return w
+	}
+	return &trackedWriter{w, t}
+}
+
+type trackedReader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r *trackedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Add(int64(n))
+	return n, err
+}
+
+type trackedWriter struct {
+	w io.Writer
+	t *Tracker
+}
+
+func (w *trackedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.t.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,258 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files are written with this suffix, and only renamed once complete
+const PARTIAL_SUFFIX = ".partial"
+
+// Conflict is what to do with the files that already exist when restoring
+type Conflict int
+
+const (
+	CONFLICT_OVERWRITE          Conflict = iota // Replace the existing file
+	CONFLICT_SKIP                               // Keep the existing file
+	CONFLICT_OVERWRITE_IF_NEWER                 // Replace the existing file only if the one in the archive has been modified after it
+	CONFLICT_RENAME                             // Keep the existing file, and restore the archived one next to it, with a different name
+)
+
+type RestoreOptions struct {
+	Destination string // Folder the archive gets extracted into (ignored if InPlace)
+	InPlace     bool   // Restore every file to its original location
+	Conflict    Conflict
+	DryRun      bool // Only print what would be done
+	Filter      *Filter
+	Checkpoint  func(entries int) // Called once the first entries of the archive have been restored (or skipped), so that an interrupted restore can resume after them
+	Progress    ProgressFunc      // Reports the progress, if set
+}
+
+type RestoreStats struct {
+	Files    uint64 `json:"files"`
+	Folders  uint64 `json:"folders"`
+	Created  uint64 `json:"created"`
+	Replaced uint64 `json:"replaced"`
+	Skipped  uint64 `json:"skipped"`
+	Renamed  uint64 `json:"renamed"`
+	Bytes    int64  `json:"bytes"` // Of the files written
+}
+
+var ErrNoSource = errors.New("the backup doesn't store the original location of the files, so it can't be restored in place")
+
+type action int
+
+const (
+	actionCreate action = iota
+	actionReplace
+	actionSkip
+	actionRename
+	actionMerge // The folder already exists
+)
+
+// Restorer resolves where each entry goes, and what should be done with it
+type Restorer struct {
+	opts    RestoreOptions
+	roots   map[string]string
+	stats   RestoreStats
+	tracker *Tracker
+}
+
+// NewRestorer needs the original locations of the paths only to restore in place.
+// If the archive is read with Untar, they are taken from the archive itself
+func NewRestorer(opts RestoreOptions, roots map[string]string) *Restorer {
+	if roots == nil {
+		roots = map[string]string{}
+	}
+	return &Restorer{opts: opts, roots: roots, tracker: NewTracker(STAGE_RESTORE, 0, 0, opts.Progress)}
+}
+
+func (r *Restorer) Stats() RestoreStats {
+	return r.stats
+}
+
+// SetTotal sets the bytes and entries expected, for the progress, if they are known before extracting (ex. from the index)
+func (r *Restorer) SetTotal(total int64, entries uint64) {
+	r.tracker.SetTotal(total, entries)
+}
+
+// Finish reports the end of the restore
+func (r *Restorer) Finish() {
+	r.tracker.Finish()
+}
+
+// target returns where the entry should be restored
+func (r *Restorer) target(name string) (string, error) {
+	if !r.opts.InPlace {
+		return filepath.Join(r.opts.Destination, name), nil
+	}
+
+	root, rest, _ := strings.Cut(cleanName(name), "/")
+	source, ok := r.roots[root]
+	if !ok {
+		return "", ErrNoSource
+	}
+	return filepath.Join(source, filepath.FromSlash(rest)), nil
+}
+
+// plan decides what to do with the entry, returning the path it will be written to
+func (r *Restorer) plan(path string, entry Entry) (action, string, error) {
+	existing, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return actionCreate, path, nil
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	// Folders are merged
+	if entry.IsDir && existing.IsDir() {
+		return actionMerge, path, nil
+	}
+
+	switch r.opts.Conflict {
+	case CONFLICT_SKIP:
+		return actionSkip, path, nil
+	case CONFLICT_OVERWRITE_IF_NEWER:
+		if !archiveTime(entry.ModTime).After(archiveTime(existing.ModTime())) {
+			return actionSkip, path, nil
+		}
+	case CONFLICT_RENAME:
+		return actionRename, freePath(path), nil
+	}
+
+	if existing.IsDir() != entry.IsDir {
+		return 0, "", fmt.Errorf("can't replace %s, since one of the two is a folder", path)
+	}
+	return actionReplace, path, nil
+}
+
+// freePath returns the first "name (n).ext" that doesn't exist yet
+func freePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Lstat(candidate); errors.Is(err, fs.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+func (r *Restorer) count(act action, entry Entry) {
+	if entry.IsDir {
+		r.stats.Folders++
+	} else {
+		r.stats.Files++
+	}
+
+	switch act {
+	case actionCreate:
+		r.stats.Created++
+	case actionReplace:
+		r.stats.Replaced++
+	case actionSkip:
+		r.stats.Skipped++
+	case actionRename:
+		r.stats.Renamed++
+	}
+}
+
+// describe tells what is being done with the entry, for the progress
+func (r *Restorer) describe(act action, path string, entry Entry) string {
+	name := entry.Name
+	size := ""
+	if !entry.IsDir {
+		size = "[" + FormatByteCount(entry.Size) + "] "
+	}
+
+	switch act {
+	case actionCreate:
+		return fmt.Sprintf("+ %s%s", size, name)
+	case actionReplace:
+		return fmt.Sprintf("~ %s%s", size, name)
+	case actionSkip:
+		return fmt.Sprintf("= %s%s (already exists)", size, name)
+	case actionRename:
+		return fmt.Sprintf("+ %s%s -> %s", size, name, path)
+	}
+	return ""
+}
+
+// checkpoint reports that the first entries of the archive are done
+func (r *Restorer) checkpoint(entries int) {
+	if r.opts.Checkpoint != nil && !r.opts.DryRun {
+		r.opts.Checkpoint(entries)
+	}
+}
+
+// extract restores the entry, reading its content from in only if needed. The content is copied to hash,
+// and the file is only moved into place if verify (when set) succeeds, so that an interrupted or invalid file never replaces an existing one
+func (r *Restorer) extract(ctx context.Context, entry Entry, in func() (io.Reader, error), hash io.Writer, verify func() error) error {
+	size := int64(0)
+	if !entry.IsDir {
+		size = entry.Size
+	}
+	r.tracker.Start(entry.Name, size)
+	line, err := r.restore(ctx, entry, in, hash, verify)
+	if err != nil {
+		return err
+	}
+	r.tracker.Done(line)
+	return nil
+}
+
+// restore does the work of extract, returning what has been done
+func (r *Restorer) restore(ctx context.Context, entry Entry, in func() (io.Reader, error), hash io.Writer, verify func() error) (string, error) {
+	path, err := r.target(entry.Name)
+	if err != nil {
+		return "", err
+	}
+	act, path, err := r.plan(path, entry)
+	if err != nil {
+		return "", err
+	}
+	r.count(act, entry)
+	line := r.describe(act, path, entry)
+
+	if r.opts.DryRun || act == actionSkip || act == actionMerge {
+		return line, nil
+	}
+	if entry.IsDir {
+		return line, os.MkdirAll(path, entry.Mode.Perm())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil { // The parent folder might have been filtered out
+		return "", err
+	}
+	content, err := in()
+	if err != nil {
+		return "", err
+	}
+	partial := path + PARTIAL_SUFFIX
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, entry.Mode.Perm())
+	if err != nil {
+		return "", err
+	}
+
+	written, err := io.Copy(io.MultiWriter(file, hash), r.tracker.Reader(ContextReader(ctx, content)))
+	file.Close()
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err == nil {
+		err = os.Chtimes(partial, time.Time{}, archiveTime(entry.ModTime)) // The same as when extracting the whole archive
+	}
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	r.stats.Bytes += written
+	return line, os.Rename(partial, path)
+}
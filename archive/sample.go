@@ -0,0 +1,31 @@
+package archive
+
+import (
+	"os"
+)
+
+// Sample returns the content of up to maxFiles small files (at most maxSize bytes each),
+// evenly spread across the paths, in order to train a compression dictionary
+func Sample(paths []string, maxFiles int, maxSize int64) ([][]byte, error) {
+	candidates := []string{}
+	err := walk(paths, func(w walkEntry) error {
+		if w.Info.Mode().IsRegular() && w.Info.Size() > 0 && w.Info.Size() <= maxSize {
+			candidates = append(candidates, w.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	step := max(len(candidates)/maxFiles, 1)
+	samples := make([][]byte, 0, min(len(candidates), maxFiles))
+	for i := 0; i < len(candidates) && len(samples) < maxFiles; i += step {
+		data, err := os.ReadFile(candidates[i])
+		if err != nil {
+			continue // It will fail later, while archiving, if it's still unreadable
+		}
+		samples = append(samples, data)
+	}
+	return samples, nil
+}
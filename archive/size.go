@@ -0,0 +1,15 @@
+package archive
+
+// Size returns the total size of the files inside of the paths, and how many files and folders there are
+func Size(paths []string) (size int64, files, folders uint64, err error) {
+	err = walk(paths, func(w walkEntry) error {
+		if w.Info.IsDir() {
+			folders++
+		} else {
+			files++
+			size += w.Info.Size()
+		}
+		return nil
+	})
+	return size, files, folders, err
+}
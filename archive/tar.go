@@ -2,111 +2,178 @@ package archive
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
-	"strings"
+
+	"lukechampine.com/blake3"
 )
 
-func Tar(paths []string, out io.Writer) (files, folders uint64, err error) {
-	tarWriter := tar.NewWriter(out)
-	defer tarWriter.Close()
-	files, folders = 0, 0
+const HASH_SIZE = 32                  // Blake3 of the archived files
+const PAX_SOURCE = "BACKUPUSB.source" // Stored in the first entry of every path, with its original location
+
+var ErrContentMismatch = errors.New("the archive doesn't match the index")
 
-	for _, fpath := range paths {
-		fpath = filepath.Clean(fpath)
+// Tar archives the paths, starting a new frame for every entry, and returns the index of the archive.
+// The frames of the index are left empty, since they are tracked by the Framer. Once the context is done, the error of the context is returned
+func Tar(ctx context.Context, paths []string, out Framer, opts TarOptions) (index *Index, files, folders uint64, err error) {
+	p := newPipeline(ctx, paths, out, opts)
+	stopOnDone := context.AfterFunc(ctx, p.stop)
+	index, files, folders, err = p.write()
+	stopOnDone()
+	p.stop()
+	p.wg.Wait() // No file is left open
+
+	// Rather than the errors of the entries which have been stopped
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return index, files, folders, err
+}
 
-		info, err := os.Stat(fpath)
+// write appends the frames of the entries in order, compressing the ones that are too big to be kept in memory
+func (p *pipeline) write() (index *Index, files, folders uint64, err error) {
+	index = &Index{Roots: map[string]string{}}
+	files, folders = 0, 0
+	tracker := NewTracker(STAGE_BACKUP, p.opts.Total, p.opts.TotalEntries, p.opts.Progress)
+
+	for job := range p.queue {
+		var frame int
+		var hash []byte
+		size := int64(0)
+		if !job.Info.IsDir() {
+			size = job.Info.Size()
+		}
+		tracker.Start(job.Name, size)
+		if job.stream {
+			hash, err = archiveEntry(p.ctx, job, p.opts.Incompressible, func(store bool) (io.Writer, error) {
+				frame, err = p.out.NewFrame(store)
+				return tracker.Writer(p.out), err
+			})
+		} else {
+			result := <-job.result
+			p.budget.Release(job.reserved)
+			hash, err = result.hash, result.err
+			if err == nil {
+				frame, err = p.out.AppendFrame(result.frame)
+			}
+		}
 		if err != nil {
-			return files, folders, err // File does not exist or is inaccessible
+			return index, files, folders, err
 		}
 
-		var baseDir string
-		if info.IsDir() {
-			baseDir = filepath.Base(fpath)
+		info := job.Info
+		if job.IsRoot {
+			index.Roots[cleanName(job.Name)] = job.Source
+		}
+		entry := IndexEntry{
+			Entry: Entry{
+				Name:    cleanName(job.Name),
+				Size:    info.Size(),
+				Mode:    info.Mode(),
+				ModTime: archiveTime(info.ModTime()), // The same as in the tar header
+				IsDir:   info.IsDir(),
+			},
+			Frame: frame,
+			Hash:  hash,
 		}
 
-		err = filepath.Walk(fpath,
-			func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				fileHeader, err := tar.FileInfoHeader(info, info.Name())
-				if err != nil {
-					return err
-				}
-
-				if baseDir != "" {
-					fileHeader.Name = filepath.Join(baseDir, strings.TrimPrefix(path, fpath))
-				}
-
-				if err := tarWriter.WriteHeader(fileHeader); err != nil {
-					return err
-				}
-
-				if info.IsDir() {
-					folders++
-					fmt.Println("+ " + fileHeader.Name)
-					return nil
-				}
-
-				fmt.Printf("+ [%s] %s\n", FormatByteCount(info.Size()), fileHeader.Name)
-				files++
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-
-				if _, err = io.Copy(tarWriter, file); err != nil {
-					return err
-				}
-				return nil
-			})
-
-		if err != nil {
-			return files, folders, err
+		if info.IsDir() {
+			folders++
+			entry.Size = 0
+			tracker.Done("+ " + job.Name)
+		} else {
+			files++
+			tracker.Done(fmt.Sprintf("+ [%s] %s", FormatByteCount(info.Size()), job.Name))
 		}
+		index.Entries = append(index.Entries, entry)
+	}
+	tracker.Finish()
+	if p.walkErr != nil {
+		return index, files, folders, p.walkErr
 	}
-	return files, folders, nil
+
+	// The end of the archive gets its own frame too, so that the last entry can be read on its own
+	if _, err := p.out.NewFrame(false); err != nil {
+		return index, files, folders, err
+	}
+	return index, files, folders, tar.NewWriter(p.out).Close()
 }
 
-func Untar(in io.Reader, out string) (files, folders uint64, err error) {
-	tarReader := tar.NewReader(in)
-	files, folders = 0, 0
+// Untar extracts the archive, as described by the options, until the context is done
+func Untar(ctx context.Context, in io.Reader, opts RestoreOptions) (RestoreStats, error) {
+	r := NewRestorer(opts, nil)
+	err := r.Untar(ctx, in)
+	r.Finish()
+	return r.Stats(), err
+}
+
+func (r *Restorer) Untar(ctx context.Context, in io.Reader) error {
+	tarReader := tar.NewReader(ContextReader(ctx, in))
 
-	for {
+	for entries := 1; ; entries++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return files, folders, err
+			return err
 		}
 
-		path := filepath.Join(out, header.Name)
-		info := header.FileInfo()
-
-		if info.IsDir() {
-			fmt.Println("+ " + header.Name)
-			folders++
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return files, folders, err
+		if source, ok := header.PAXRecords[PAX_SOURCE]; ok {
+			r.roots[cleanName(header.Name)] = source
+		}
+		if r.opts.Filter.Match(header.Name) {
+			content := func() (io.Reader, error) { return tarReader, nil }
+			if err := r.extract(ctx, entryFromHeader(header), content, io.Discard, nil); err != nil {
+				return err
 			}
-			continue
 		}
+		r.checkpoint(entries)
+	}
+	return nil
+}
 
-		fmt.Printf("+ [%s] %s\n", FormatByteCount(info.Size()), header.Name)
-		files++
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+// UntarEntry extracts a single entry, checking that its content matches the hash stored in the index.
+// The archive, which must start with the entry, is opened only if the content is needed
+func (r *Restorer) UntarEntry(ctx context.Context, entry IndexEntry, open func() (io.Reader, error)) error {
+	var header *tar.Header
+	content := func() (io.Reader, error) {
+		in, err := open()
 		if err != nil {
-			return files, folders, err
+			return nil, err
 		}
-		defer file.Close()
-		
-		if _, err = io.Copy(file, tarReader); err != nil {
-			return files, folders, err
+
+		tarReader := tar.NewReader(in)
+		if header, err = tarReader.Next(); err != nil {
+			return nil, err
 		}
+		if cleanName(header.Name) != entry.Name {
+			return nil, ErrContentMismatch
+		}
+		return tarReader, nil
+	}
+
+	hash := blake3.New(HASH_SIZE, nil)
+	return r.extract(ctx, entry.Entry, content, hash, func() error {
+		if !bytes.Equal(hash.Sum(nil), entry.Hash) {
+			return fmt.Errorf("%w, the content of %s is different. It seems like the file has been tampered with", ErrContentMismatch, entry.Name)
+		}
+		return nil
+	})
+}
+
+func entryFromHeader(header *tar.Header) Entry {
+	info := header.FileInfo()
+	return Entry{
+		Name:    cleanName(header.Name),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
 	}
-	return files, folders, nil
 }
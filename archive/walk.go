@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrSourceMissing = errors.New("the path to back up doesn't exist")
+
+type walkEntry struct {
+	Path   string // Where it is on disk
+	Name   string // Where it is inside of the archive
+	Source string // Absolute path of the backed up path it belongs to
+	IsRoot bool   // It is the backed up path itself
+	Info   os.FileInfo
+}
+
+// walk visits every file and folder inside of the paths, naming them the same way they are stored in the archive.
+// Links and other special files are skipped, since only the content of regular files is stored
+func walk(paths []string, fn func(walkEntry) error) error {
+	for _, fpath := range paths {
+		fpath = filepath.Clean(fpath)
+
+		info, err := os.Stat(fpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrSourceMissing, fpath)
+		} else if err != nil {
+			return err // Inaccessible
+		}
+
+		var baseDir string
+		if info.IsDir() {
+			baseDir = filepath.Base(fpath)
+		}
+
+		// Keep track of where it came from, to be able to restore it in place
+		source, err := filepath.Abs(fpath)
+		if err != nil {
+			return err
+		}
+
+		err = filepath.Walk(fpath,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && !info.Mode().IsRegular() {
+					return nil
+				}
+
+				name := info.Name()
+				if baseDir != "" {
+					name = filepath.Join(baseDir, strings.TrimPrefix(path, fpath))
+				}
+
+				return fn(walkEntry{
+					Path:   path,
+					Name:   name,
+					Source: source,
+					IsRoot: path == fpath,
+					Info:   info,
+				})
+			})
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
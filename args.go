@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// popFlag removes every occurrence of a boolean flag (ex. --tar) from the arguments, reporting if it was found
+func popFlag(args []string, name string) ([]string, bool) {
+	found := false
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == name {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+// popValues removes every occurrence of a flag with a value (ex. --include "a" or --include="a") from the arguments, returning its values
+func popValues(args []string, name string) ([]string, []string, error) {
+	var values []string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			values = append(values, parsePath(value))
+			continue
+		}
+		if arg != name {
+			rest = append(rest, arg)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return nil, nil, fmt.Errorf("missing value for %s", name)
+		}
+		i++
+		values = append(values, parsePath(args[i]))
+	}
+	return rest, values, nil
+}
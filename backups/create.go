@@ -2,77 +2,461 @@ package backups
 
 import (
 	"backupusb/archive"
+	"backupusb/compression"
 	"backupusb/crypto"
+	"backupusb/storage"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"sort"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupName matches the names of the backups, the unix time in milliseconds when they were created
+var backupName = regexp.MustCompile(`^[0-9]+$`)
 
-	"github.com/klauspost/compress/zstd"
+type backupKind int
+
+const (
+	notBackup backupKind = iota
+	currentBackup
+	legacyBackup // Named like a backup, but without the magic: either a backup from before the preamble (version 0), or any other file
 )
 
-func DeleteOldBackups(folderPath string, amount int) {
-	files, err := os.ReadDir(folderPath)
+// kindOf tells if the file has been created by this program, from its name and its magic, so that the retention never touches anything else.
+// Backups from before the preamble (version 0) can't be told apart from any other file named the same way, so they are only legacy ones
+func kindOf(dest storage.Destination, file storage.Info) backupKind {
+	if !backupName.MatchString(file.Name) {
+		return notBackup
+	}
+	object, err := dest.Open(file.Name)
 	if err != nil {
-		panic(err)
+		return notBackup
 	}
+	defer object.Close()
 
-	if amount < -1 || amount == 0 {
-		fmt.Printf("Invalid backups value in config file: %d", amount)
-		fmt.Printf("Set it to a positive integer to limit the amount of backups in the data folder, or you can set it -1 to disable this feature")
-		os.Exit(1)
+	magic := make([]byte, len(MAGIC))
+	if _, err := io.ReadFull(io.NewSectionReader(object, 0, int64(len(magic))), magic); err != nil {
+		return notBackup
 	}
+	if string(magic) != MAGIC {
+		if file.Size < crypto.MACSUM_SIZE { // Too small to even have the macsum
+			return notBackup
+		}
+		return legacyBackup
+	}
+	return currentBackup
+}
 
-	if amount != -1 && len(files) >= amount {
-		sort.SliceStable(files, func(i, j int) bool { // Sort reversed
-			return files[i].Name() > files[j].Name()
-		})
+// listBackups returns the backups of the destination, ignoring every other file (and the uploads which haven't been completed yet).
+// The legacy ones are included only if asked to, and otherwise returned apart
+func listBackups(dest storage.Destination, withLegacy bool) (files, legacy []storage.Info, err error) {
+	all, err := dest.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range all {
+		switch kindOf(dest, file) {
+		case currentBackup:
+			files = append(files, file)
+		case legacyBackup:
+			if withLegacy {
+				files = append(files, file)
+			} else {
+				legacy = append(legacy, file)
+			}
+		}
+	}
+	return files, legacy, nil
+}
 
-		for _, file := range files[amount-1:] {
-			os.Remove(folderPath + file.Name())
+// RemoveInterrupted removes the temporary files of the backups whose creation has been interrupted (ex. the program killed, or the usb stick
+// unplugged), returning their names. They can't be resumed, since the keys of a backup only exist while it's being written.
+// The interrupted uploads of the reports are removed too
+func RemoveInterrupted(dest storage.Destination) ([]string, error) {
+	files, err := dest.List()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	errs := []error{}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name, storage.TEMP_SUFFIX)
+		if ok && backupName.MatchString(strings.TrimSuffix(name, REPORT_SUFFIX)) {
+			if err := dest.Remove(file.Name); err != nil {
+				errs = append(errs, err)
+			} else {
+				removed = append(removed, file.Name)
+			}
 		}
 	}
+	return removed, errors.Join(errs...)
 }
 
-func removePanic(f *os.File, err error) {
-	f.Close()
-	os.Remove(f.Name())
-	panic(err)
+// abort removes the incomplete upload, returning the error which caused it
+func abort(out storage.Upload, err error) error {
+	out.Abort()
+	return err
 }
 
-func CreateBackup(outFile *os.File, pubKey [crypto.PUB_KEY_SIZE]byte, paths []string) (fileN uint64, folderN uint64) {
-	outFile.Write(make([]byte, crypto.MACSUM_SIZE)) // Make space for the future macsum
-	header, enHeader := crypto.GenHeader(pubKey)
+// trainDictionary samples the small files of the paths. If there aren't enough, the backup is simply created without a dictionary
+func trainDictionary(paths []string, settings compression.Settings, log Logger) ([]byte, error) {
+	log.Printf("Training the compression dictionary...")
+	trainStartTime := time.Now()
+
+	samples, err := archive.Sample(paths, compression.DICTIONARY_SAMPLES, compression.DICTIONARY_SAMPLE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := compression.TrainDictionary(samples, settings)
+	if err != nil {
+		log.Printf("Skipping the dictionary: %v\n", err)
+		return nil, nil
+	}
+
+	log.Printf("Trained a %s dictionary from %d files in %v\n", archive.FormatByteCount(int64(len(dict))), len(samples), time.Since(trainStartTime).Round(time.Millisecond))
+	return dict, nil
+}
+
+// BackupStats describes a backup just created
+type BackupStats struct {
+	Files   uint64
+	Folders uint64
+	In      int64 // Size of the archive, before compressing it
+	Out     int64 // Size of the backup
+	MAC     []byte
+}
+
+// createBackup writes the backup to out, and closes it, or aborts it if anything fails or the context is done. Nothing is ever read back,
+// so it can be streamed to a remote destination
+func createBackup(ctx context.Context, out storage.Upload, pubKey [crypto.PUB_KEY_SIZE]byte, paths []string, settings compression.Settings, tarOpts archive.TarOptions, log Logger) (BackupStats, error) {
+	stats := BackupStats{}
+	flags := FLAG_INDEX | FLAG_CHECKSUM | FLAG_KEY_CHECK
+	if settings.TrainDictionary {
+		dict, err := trainDictionary(paths, settings, log)
+		if err != nil {
+			return stats, abort(out, err)
+		}
+		settings.Dictionary = dict
+	}
+	if len(settings.Dictionary) > 0 {
+		flags |= FLAG_DICTIONARY
+	}
+
+	header, enHeader, err := crypto.GenHeader(pubKey)
+	if err != nil {
+		return stats, abort(out, err)
+	}
+	defer header.Destroy()
 
 	// Prepare the writers
 	mac := crypto.NewMAC(header.MacKey)
-	macAndFile := io.MultiWriter(outFile, mac)
+	checksum := crypto.NewChecksum()
+	counted := &countingWriter{w: out}
+	file := io.MultiWriter(counted, checksum)
+	macAndFile := io.MultiWriter(file, mac)
 	aesWriter, err := crypto.NewAesWriter(header.AesKey, header.IV, macAndFile)
 	if err != nil {
-		removePanic(outFile, err)
+		return stats, abort(out, err)
 	}
 
-	// Write header
+	// Write preamble and header
+	if _, err := macAndFile.Write(newPreamble(flags, settings.Codec)); err != nil {
+		return stats, abort(out, err)
+	}
 	if _, err := macAndFile.Write(enHeader.Dump()); err != nil {
-		removePanic(outFile, err)
+		return stats, abort(out, err)
+	}
+	if _, err := macAndFile.Write(header.KeyCheck()); err != nil {
+		return stats, abort(out, err)
+	}
+
+	// The dictionary is needed before any frame can be decompressed
+	if flags&FLAG_DICTIONARY != 0 {
+		if _, err := aesWriter.Write(dumpDictionary(settings.Dictionary)); err != nil {
+			return stats, abort(out, err)
+		}
 	}
 
 	// Compress, encrypt and write
-	fmt.Println("Compressing...")
-	zstdWriter, err := zstd.NewWriter(aesWriter, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderConcurrency(4)) // Compression level 5. Apprently we can keep concurrency here
+	log.Printf("Compressing (%s)...", settings.Codec)
+	frameWriter := newFrameWriter(aesWriter, settings)
+	index, fileN, folderN, err := archive.Tar(ctx, paths, frameWriter, tarOpts)
 	if err != nil {
-		removePanic(outFile, err)
+		return stats, abort(out, err)
 	}
-	if fileN, folderN, err = archive.Tar(paths, zstdWriter); err != nil {
-		removePanic(outFile, err)
+	if err := frameWriter.Close(); err != nil {
+		return stats, abort(out, err)
+	}
+	index.Frames = frameWriter.frames
+	log.Printf("\n%s", frameWriter.Report())
+	stats.Files, stats.Folders = fileN, folderN
+	for _, frames := range frameWriter.stats {
+		stats.In += frames.In
 	}
-	zstdWriter.Close()
 
-	// Flush the remaining buffer and write the macsum at the start of the file
-	outFile.Seek(0, 0)
+	// Append the index, right after the data
+	enIndex, err := encodeIndex(index)
+	if err != nil {
+		return stats, abort(out, err)
+	}
+	if _, err := aesWriter.Write(enIndex); err != nil {
+		return stats, abort(out, err)
+	}
+	tail := trailer{
+		IndexOffset: frameWriter.out.n,
+		IndexSize:   int64(len(enIndex)),
+		IndexMac:    indexMac(header.MacKey, frameWriter.out.n, enIndex),
+	}
+	if _, err := macAndFile.Write(tail.Dump()); err != nil {
+		return stats, abort(out, err)
+	}
+
+	// Everything the macsum covers is stored before the macsum itself, and the upload is synced again when closed
+	if syncer, ok := out.(storage.Syncer); ok {
+		if err := syncer.Sync(); err != nil {
+			return stats, abort(out, err)
+		}
+	}
+
+	// The macsum of everything written so far, followed by the checksum which can be verified without the private key
 	msum := mac.Sum(nil)
-	header.Destroy()
-	outFile.Write(msum) // Write the 64 bytes of encrypted macsum (this writes to the mac too, but we already evaluated the sum)
+	if _, err := file.Write(msum); err != nil {
+		return stats, abort(out, err)
+	}
+	if _, err := counted.Write(checksum.Sum(nil)); err != nil {
+		return stats, abort(out, err)
+	}
+	if err := out.Close(); err != nil {
+		return stats, abort(out, err)
+	}
+
+	stats.Out, stats.MAC = counted.n, msum
+	return stats, nil
+}
+
+// CreateOptions describe a backup, and where to store it
+type CreateOptions struct {
+	PublicKey    [crypto.PUB_KEY_SIZE]byte
+	Paths        []string
+	Destinations []string // Folders, or sftp://, s3:// and webdav:// urls
+	RequireAll   bool     // Fail if any destination fails, instead of only when all of them do
+	Compression  compression.Settings
+	Tar          archive.TarOptions // Its progress and totals are set by Create
+	Retention    Retention
+	PruneEarly   bool // Without enough space for the backup, remove the older ones which the retention would remove afterwards
+	Report       bool // Store the report next to the backup, in every destination
+	Logger       Logger
+	Progress     archive.ProgressFunc
+}
+
+// makeRoom makes sure that the destination has room for the new backup, removing the older ones first if allowed
+func makeRoom(dest storage.Destination, opts CreateOptions, input int64, log Logger) error {
+	estimate, err := EstimateBackup(dest, opts.Retention, input)
+	if err != nil {
+		return err
+	}
+	if estimate.Fits() {
+		return nil
+	}
+	needed, free := archive.FormatByteCount(estimate.Needed), archive.FormatByteCount(estimate.Free)
+	if !estimate.FitsAfterPruning() {
+		return fmt.Errorf("%w, the backup needs about %s but only %s are free, even after removing the older backups", ErrNotEnoughSpace, needed, free)
+	}
+	if !opts.PruneEarly {
+		return fmt.Errorf("%w, the backup needs about %s but only %s are free. Enable prune early in the config to remove the older backups first", ErrNotEnoughSpace, needed, free)
+	}
+
+	log.Printf("Not enough space in %s, removing the older backups first", dest)
+	for _, removal := range estimate.MakeRoom(dest) {
+		if removal.Err != nil {
+			log.Printf("  Unable to remove %s: %v", removal.Name, removal.Err)
+		} else {
+			log.Printf("  Removed %s (%s)", removal.Name, removal.Reason)
+		}
+	}
+	if !estimate.Fits() {
+		return fmt.Errorf("%w, even after removing the older backups", ErrNotEnoughSpace)
+	}
+	return nil
+}
+
+// openDestination connects to the destination, and starts the upload of the backup once the interrupted ones have been removed
+func openDestination(location, name string, opts CreateOptions, input int64, log Logger) (storage.Destination, storage.Upload, error) {
+	dest, err := storage.Open(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err := RemoveInterrupted(dest)
+	for _, file := range removed {
+		log.Printf("Removed the interrupted backup %s from %s", file, dest)
+	}
+	if err != nil {
+		log.Printf("Unable to remove the interrupted backups from %s: %v", dest, err)
+	}
+
+	if err := makeRoom(dest, opts, input, log); err != nil {
+		dest.Close()
+		return nil, nil, err
+	}
+	upload, err := dest.Create(name)
+	if err != nil {
+		dest.Close()
+		return nil, nil, err
+	}
+	return dest, upload, nil
+}
+
+// Create backs up the paths to every destination, then verifies the backup stored in each of them before applying the retention there.
+// The report is returned even if the backup fails, with the errors in it. If the destinations failed, the error wraps ErrBackupFailed
+// together with a DestinationError for each of them
+func Create(ctx context.Context, opts CreateOptions) (*Report, error) {
+	log := orDiscard(opts.Logger)
+	report := NewReport("backup")
+	report.Backup = strconv.FormatInt(report.Started.UnixMilli(), 10)
+	report.Codec = opts.Compression.Codec.String()
+	fail := func(err error) (*Report, error) {
+		report.Fail(err)
+		report.Finish()
+		return report, err
+	}
+
+	if err := opts.Retention.Validate(); err != nil {
+		return fail(fmt.Errorf("%w: %v", ErrInvalidOptions, err))
+	}
+	if err := opts.Compression.Validate(); err != nil {
+		return fail(fmt.Errorf("%w: %v", ErrInvalidOptions, err))
+	}
+	if len(opts.Destinations) == 0 {
+		return fail(ErrNoDestination)
+	}
 
-	return fileN, folderN
+	// The size of the files, to check that every destination has room for the backup
+	inputSize, inputFiles, inputFolders, err := archive.Size(opts.Paths)
+	if err != nil {
+		return fail(fmt.Errorf("unable to read the paths: %w", err))
+	}
+
+	// Connect to the destinations (local folders, or remote servers)
+	out := storage.NewMultiUpload(opts.RequireAll)
+	dests := map[string]storage.Destination{}
+	defer func() {
+		for _, dest := range dests {
+			dest.Close()
+		}
+	}()
+	for _, location := range opts.Destinations {
+		if err := ctx.Err(); err != nil {
+			out.Abort()
+			return fail(err)
+		}
+		dest, upload, err := openDestination(location, report.Backup, opts, inputSize, log)
+		if err != nil {
+			name := storage.Redact(location)
+			if opts.RequireAll {
+				out.Abort()
+				return fail(&DestinationError{Destination: name, Err: err})
+			}
+			log.Printf("Skipping the destination %s: %v", name, err)
+			out.Fail(name, err)
+			continue
+		}
+		out.Add(dest.String(), upload)
+		dests[dest.String()] = dest
+	}
+	if out.Failed() == len(opts.Destinations) {
+		return fail(ErrNoDestination)
+	}
+	for _, target := range out.Targets() {
+		if target.Err == nil {
+			log.Printf("Backing up to %s", target.Name)
+		}
+	}
+
+	// Backup to the files
+	tarOpts := opts.Tar
+	tarOpts.Progress = opts.Progress
+	tarOpts.Total, tarOpts.TotalEntries = inputSize, inputFiles+inputFolders
+	stats, err := createBackup(ctx, out, opts.PublicKey, opts.Paths, opts.Compression, tarOpts, log)
+	if err != nil {
+		return fail(err)
+	}
+	report.Files, report.Folders, report.BytesIn, report.BytesOut = stats.Files, stats.Folders, stats.In, stats.Out
+	report.MAC = hex.EncodeToString(stats.MAC)
+	if stats.In > 0 {
+		report.Ratio = float64(stats.Out) / float64(stats.In)
+	}
+
+	// The older backups are only removed once the new one has been read back and verified
+	log.Printf("\nDestinations:")
+	failed, legacy := 0, 0
+	causes := []error{}
+	for _, target := range out.Targets() {
+		if err := ctx.Err(); err != nil { // The backup is complete, but the older ones are only removed from the destinations where it has been verified
+			return fail(err)
+		}
+		destReport := DestinationReport{Name: target.Name}
+		if target.Err != nil {
+			log.Printf("  - %s: failed (%v)", target.Name, target.Err)
+			destReport.Error = target.Err.Error()
+			report.Destinations = append(report.Destinations, destReport)
+			causes = append(causes, &DestinationError{Destination: target.Name, Err: target.Err})
+			failed++
+			continue
+		}
+		dest := dests[target.Name]
+		destReport.File = BackupFile(dest, report.Backup)
+		if err := VerifyChecksum(dest, report.Backup); err != nil {
+			log.Printf("  - %s: failed, the stored backup is invalid (%v)", target.Name, err)
+			destReport.Error = "the stored backup is invalid: " + err.Error()
+			report.Destinations = append(report.Destinations, destReport)
+			causes = append(causes, &DestinationError{Destination: target.Name, Err: err})
+			failed++
+			continue
+		}
+
+		log.Printf("  - %s: ok", target.Name)
+		destReport.Ok = true
+		removals, skipped, err := Prune(dest, opts.Retention, false)
+		if err != nil {
+			log.Printf("      Unable to apply the retention: %v", err)
+		}
+		legacy += len(skipped)
+		for _, removal := range removals {
+			if removal.Err != nil {
+				log.Printf("      Unable to remove %s: %v", removal.Name, removal.Err)
+			} else {
+				log.Printf("      Removed %s (%s)", removal.Name, removal.Reason)
+				destReport.Removed = append(destReport.Removed, removal.Name)
+			}
+		}
+		report.Destinations = append(report.Destinations, destReport)
+	}
+	if legacy > 0 {
+		log.Printf("\n%s", LegacyWarning(legacy))
+	}
+	var failErr error
+	if failed == len(out.Targets()) || (failed > 0 && opts.RequireAll) {
+		failErr = fmt.Errorf("%w in %d of %d destinations", ErrBackupFailed, failed, len(out.Targets()))
+		report.Fail(failErr)
+		failErr = errors.Join(append([]error{failErr}, causes...)...) // The report already tells what happened to each destination
+	}
+
+	// The same report is stored next to the backup, in every destination where it's valid
+	report.Finish()
+	if opts.Report {
+		for _, destReport := range report.Destinations {
+			if destReport.Ok {
+				if err := WriteReport(dests[destReport.Name], report.Backup, report); err != nil {
+					log.Printf("Unable to store the report in %s: %v", destReport.Name, err)
+				}
+			}
+		}
+	}
+	return report, failErr
 }
@@ -2,84 +2,418 @@ package backups
 
 import (
 	"backupusb/archive"
+	"backupusb/compression"
 	"backupusb/crypto"
+	"backupusb/storage"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"time"
-
-	"github.com/klauspost/compress/zstd"
 )
 
-func DecryptBackup(path, destination string, privKey []byte, extract bool) (uint64, uint64) {
+// backupFile is an opened backup, whose header has already been decrypted
+type backupFile struct {
+	file      storage.Object
+	flags     byte
+	settings  compression.Settings // Codec and dictionary needed to decompress the frames
+	macSum    []byte
+	mac       hash.Hash // Already contains the preamble and the header
+	header    *crypto.Header
+	macStart  int64 // Where the part of the file not yet covered by the mac starts
+	macEnd    int64 // Where the part covered by the mac ends (the macsum itself is at the end since version 3, only followed by the checksum)
+	aesOffset int64 // Size of the encrypted dictionary, if any, which comes before the data in the aes stream
+	dataStart int64
+	dataSize  int64
+	trailer   *trailer // Only if FLAG_INDEX is set
+}
+
+func openBackup(path string, privKey []byte) (*backupFile, error) {
 
-	// Open file
-	inFile, err := os.Open(path)
+	// Open file, which might be on a remote destination
+	object, err := storage.OpenFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer inFile.Close()
+	b := &backupFile{file: object}
+	inFile := io.NewSectionReader(object, 0, object.Size()) // Read in order, up to the header
 
-	// Read the macsum
-	macSum := make([]byte, crypto.MACSUM_SIZE)
-	if _, err := io.ReadFull(inFile, macSum); err != nil {
-		panic(err)
+	// Read the preamble, if there is one
+	preamble := make([]byte, PREAMBLE_SIZE)
+	if _, err := io.ReadFull(inFile, preamble); err != nil {
+		object.Close()
+		return nil, err
+	}
+	version := byte(0)
+	if string(preamble[:len(MAGIC)]) == MAGIC {
+		version = preamble[len(MAGIC)]
+		if version > FORMAT_VERSION {
+			object.Close()
+			return nil, ErrNewerVersion
+		}
+		b.flags = preamble[len(MAGIC)+1]
+
+		if version == 1 { // No codec, always zstd
+			preamble = preamble[:len(MAGIC)+2]
+			inFile.Seek(int64(len(preamble)), io.SeekStart)
+		} else {
+			b.settings.Codec = compression.Codec(preamble[len(MAGIC)+2])
+		}
+	} else {
+		preamble = nil // Version 0, the file starts with the macsum
+		inFile.Seek(0, io.SeekStart)
+	}
+
+	b.macEnd = object.Size()
+	if version >= 3 && b.flags&FLAG_CHECKSUM != 0 {
+		b.macEnd -= crypto.CHECKSUM_SIZE
+	}
+
+	// Read the macsum, which is either right after the preamble, or at the end of the file
+	b.macSum = make([]byte, crypto.MACSUM_SIZE)
+	b.macStart = int64(len(preamble))
+	if version >= 3 {
+		b.macEnd -= crypto.MACSUM_SIZE
+		_, err = io.ReadFull(io.NewSectionReader(object, b.macEnd, crypto.MACSUM_SIZE), b.macSum) // ReadAt may also return EOF at the end
+	} else {
+		_, err = io.ReadFull(inFile, b.macSum)
+		b.macStart += crypto.MACSUM_SIZE
+	}
+	if err != nil {
+		object.Close()
+		return nil, err
 	}
 
 	// Read the file header (keys)
-	header, mac, err := crypto.ReadHeader(inFile, privKey)
+	b.header, b.mac, err = crypto.ReadHeader(inFile, privKey, preamble)
 	if err != nil {
-		panic(err)
+		object.Close()
+		return nil, err
+	}
+	b.macStart += int64(crypto.ENCRYPTED_HEADER_SIZE)
+
+	// Without the key check (older backups), a wrong private key only shows up as an invalid macsum
+	if version >= 4 && b.flags&FLAG_KEY_CHECK != 0 {
+		check := make([]byte, crypto.KEY_CHECK_SIZE)
+		if _, err := io.ReadFull(inFile, check); err != nil {
+			b.Close()
+			return nil, err
+		}
+		if err := b.header.VerifyKeyCheck(check); err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.mac.Write(check)
+		b.macStart += crypto.KEY_CHECK_SIZE
+	}
+	b.dataStart = b.macStart
+
+	// Read the dictionary, which is right after the header
+	if b.flags&FLAG_DICTIONARY != 0 {
+		section := io.NewSectionReader(object, b.dataStart, MAX_DICTIONARY_SECTION+4)
+		aesReader, err := crypto.NewAesReaderAt(b.header.AesKey, b.header.IV, 0, section)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		if b.settings.Dictionary, err = readDictionary(aesReader); err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.aesOffset = int64(4 + len(b.settings.Dictionary))
+		b.dataStart += b.aesOffset
+	}
+
+	// Find where the data ends
+	b.dataSize = b.macEnd - b.dataStart
+	if b.flags&FLAG_INDEX != 0 {
+		data := make([]byte, TRAILER_SIZE)
+		if _, err := object.ReadAt(data, b.macEnd-TRAILER_SIZE); err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.trailer, _ = parseTrailer(data)
+		if b.trailer.IndexOffset+b.trailer.IndexSize+TRAILER_SIZE != b.dataSize {
+			b.Close()
+			return nil, fmt.Errorf("invalid trailer. It seems like %w", ErrTampered)
+		}
+		b.dataSize = b.trailer.IndexOffset
 	}
+	return b, nil
+}
+
+func (b *backupFile) Close() {
+	b.header.Destroy()
+	b.file.Close()
+}
 
-	// Verify file integrity
+// Verify checks the macsum of the whole file, reporting the progress if progress is set, until the context is done
+func (b *backupFile) Verify(ctx context.Context, progress archive.ProgressFunc, log Logger) error {
 	verStartTime := time.Now()
-	fmt.Println("Verifying file integrity...")
-	if _, err = io.Copy(mac, inFile); err != nil {
-		panic(err)
+	log.Printf("Verifying file integrity...")
+	tracker := archive.NewTracker(archive.STAGE_VERIFY, b.macEnd-b.macStart, 0, progress)
+	if _, err := io.Copy(tracker.Writer(b.mac), archive.ContextReader(ctx, io.NewSectionReader(b.file, b.macStart, b.macEnd-b.macStart))); err != nil {
+		return err
+	}
+	tracker.Finish()
+	if err := crypto.VerifyMacSum(b.macSum, b.mac.Sum(nil)); err != nil {
+		return fmt.Errorf("%w. It seems like %w", err, ErrTampered)
+	}
+	log.Printf("Integrity verified in %v\n", time.Since(verStartTime))
+	return nil
+}
+
+// decompress returns a reader of the decrypted and decompressed archive, starting from the given offset of the data
+func (b *backupFile) decompress(offset, size int64) (io.ReadCloser, error) {
+	return b.decompressWith(offset, size, 0)
+}
+
+// decompressWith is like decompress, but limits the goroutines used by the decoder (0 for the default)
+func (b *backupFile) decompressWith(offset, size int64, concurrency int) (io.ReadCloser, error) {
+	section := &recordingReader{r: io.NewSectionReader(b.file, b.dataStart+offset, size)}
+	aesReader, err := crypto.NewAesReaderAt(b.header.AesKey, b.header.IV, b.aesOffset+offset, section)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := b.settings
+	settings.Concurrency = concurrency
+	decoder, err := compression.NewDecoder(aesReader, settings)
+	if err != nil {
+		return nil, err
+	}
+	return &frameReader{decoder, section}, nil
+}
+
+// recordingReader keeps the error of the file, if reading it fails
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// frameReader tells the errors of the decoder apart from the ones of the file: data which has been read correctly,
+// but can't be decompressed, has been modified (it's only authenticated afterwards, by the hashes in the index)
+type frameReader struct {
+	io.ReadCloser
+	file *recordingReader
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && f.file.err == nil {
+		err = fmt.Errorf("invalid frame (%v). It seems like %w", err, ErrTampered)
+	}
+	return n, err
+}
+
+// Archive returns a reader of the whole archive. It should only be used after verifying the file.
+// If the backup has an index, its frames are decompressed in parallel
+func (b *backupFile) Archive() (io.ReadCloser, error) {
+	if b.trailer == nil {
+		return b.decompress(0, b.dataSize)
 	}
-	if !crypto.CompareMacSums(macSum, mac.Sum(nil)) {
-		fmt.Printf("Invalid macsum. It seems like the file has been tampered with (%v)\n", time.Since(verStartTime))
-		os.Exit(1)
+
+	index, err := b.ReadIndex()
+	if err != nil {
+		return nil, err
 	}
-	fmt.Printf("Integrity verified in %v\n\n", time.Since(verStartTime))
-	inFile.Seek(int64(crypto.ENCRYPTED_HEADER_SIZE+crypto.MACSUM_SIZE), 0) // Back to the encrypted data start
+	for _, frame := range index.Frames {
+		if frame.Offset < 0 || frame.Size < 0 || frame.Offset+frame.Size > b.dataSize {
+			return nil, errors.New("invalid index frame")
+		}
+	}
+	return b.parallelArchive(index), nil
+}
 
-	// Create AES reader
-	aesReader, err := crypto.NewAesReader(header.AesKey, header.IV, inFile)
+// ReadIndex decrypts and authenticates the index, without reading the rest of the file.
+// Returns nil if the backup doesn't have one
+func (b *backupFile) ReadIndex() (*archive.Index, error) {
+	if b.trailer == nil {
+		return nil, nil
+	}
+
+	section := io.NewSectionReader(b.file, b.dataStart+b.trailer.IndexOffset, b.trailer.IndexSize)
+	aesReader, err := crypto.NewAesReaderAt(b.header.AesKey, b.header.IV, b.aesOffset+b.trailer.IndexOffset, section)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(aesReader)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if err := crypto.VerifyMacSum(b.trailer.IndexMac, indexMac(b.header.MacKey, b.trailer.IndexOffset, data)); err != nil {
+		return nil, fmt.Errorf("%w of the index. It seems like %w", err, ErrTampered)
+	}
+	return decodeIndex(data)
+}
+
+// OpenEntry returns a reader of the archive starting from the i-th entry of the index
+func (b *backupFile) OpenEntry(index *archive.Index, i int) (io.ReadCloser, error) {
+	offset, size := index.EntrySpan(i)
+	if offset < 0 || size < 0 || offset+size > b.dataSize {
+		return nil, errors.New("invalid index entry")
+	}
+	return b.decompress(offset, size)
+}
+
+// RestoreOptions describe which backup to restore, and how
+type RestoreOptions struct {
+	archive.RestoreOptions        // Where the files go, and which ones. The checkpoint is set by Restore
+	Backup                 string // Path or url of the backup
+	PrivateKey             []byte
+	TarOnly                bool // Only decrypt and decompress the archive, to <name>.tar in the current folder
+	Logger                 Logger
+}
+
+// Restore extracts the backup as described by the options. Unless restoring in place,
+// the files are extracted to a "_<backup name>" folder inside of the destination
+func Restore(ctx context.Context, opts RestoreOptions) (archive.RestoreStats, error) {
+	log := orDiscard(opts.Logger)
+	if err := ctx.Err(); err != nil {
+		return archive.RestoreStats{}, err
+	}
+	backup, err := openBackup(opts.Backup, opts.PrivateKey)
+	if err != nil {
+		return archive.RestoreStats{}, err
+	}
+	defer backup.Close()
+	name := storage.Name(opts.Backup)
+	extract := opts.RestoreOptions
+	extract.Destination = filepath.Join(extract.Destination, "_"+name)
+
+	// Backups with an index can be resumed from the last entry restored, if interrupted
+	var resume *restoreResume
+	from := 0
+	if !opts.TarOnly && !extract.DryRun && backup.trailer != nil {
+		resume = newRestoreResume(opts.Backup, backup.macSum, &extract, log)
+		if from = resume.checkpoint.Entries; from > 0 {
+			log.Printf("Resuming the interrupted restore after %d entries", from)
+		}
+	}
+
+	// Only some files (or none at all), which can be read on their own
+	if !opts.TarOnly && (!extract.Filter.IsEmpty() || extract.DryRun || from > 0) && backup.trailer != nil {
+		stats, err := extractFromIndex(ctx, backup, extract, from, log)
+		if err == nil {
+			resume.done()
+		} else {
+			resume.flush()
+		}
+		return stats, err
 	}
 
-	// Set up decompression (don't extract yet)
-	zstdReader, err := zstd.NewReader(aesReader, zstd.WithDecoderConcurrency(1)) // No need to specify compression level. If concurrency is enabled (>1) the end of the file isn't copied
+	if err := backup.Verify(ctx, extract.Progress, log); err != nil {
+		return archive.RestoreStats{}, err
+	}
+	reader, err := backup.Archive()
 	if err != nil {
-		panic(err)
+		return archive.RestoreStats{}, err
 	}
-	defer zstdReader.Close()
+	defer reader.Close()
 
 	// Decrypt only
-	if !extract {
-		outFile, err := os.Create(filepath.Join(filepath.Base(path) + ".tar"))
+	if opts.TarOnly {
+		outFile, err := os.Create(name + ".tar")
 		if err != nil {
-			panic(err)
+			return archive.RestoreStats{}, err
 		}
 		defer outFile.Close()
 
-		io.Copy(outFile, zstdReader)
-		return 1, 0
+		written, err := io.Copy(outFile, archive.ContextReader(ctx, reader))
+		if err != nil { // Otherwise the end of the archive could be silently missing
+			outFile.Close()
+			os.Remove(outFile.Name())
+			return archive.RestoreStats{}, err
+		}
+		return archive.RestoreStats{Files: 1, Bytes: written}, nil
 	}
 
 	// Decrypt and extract
-	fmt.Println("Extracting...")
-	folderName := filepath.Join(destination, "_"+filepath.Base(path))
-	os.Mkdir(folderName, os.ModePerm)
+	log.Printf("Extracting...")
+	if !extract.InPlace && !extract.DryRun {
+		os.Mkdir(extract.Destination, os.ModePerm)
+	}
 
-	fileN, folderN, err := archive.Untar(zstdReader, folderName)
-	header.Destroy()
+	restorer := archive.NewRestorer(extract, nil)
+	if backup.trailer != nil && extract.Progress != nil {
+		index, err := backup.ReadIndex()
+		if err != nil {
+			return archive.RestoreStats{}, err
+		}
+		restorer.SetTotal(restoreTotal(index, extract.Filter, 0))
+	}
+	err = restorer.Untar(ctx, reader)
+	restorer.Finish()
 	if err != nil {
-		panic(err)
+		resume.flush()
+		return restorer.Stats(), err
+	}
+	resume.done()
+	return restorer.Stats(), nil
+}
+
+// restoreTotal returns the bytes and entries of the index which will be restored, for the progress
+func restoreTotal(index *archive.Index, filter *archive.Filter, from int) (size int64, entries uint64) {
+	for _, entry := range index.Entries[from:] {
+		if filter.Match(entry.Name) {
+			size += entry.Size
+			entries++
+		}
+	}
+	return size, entries
+}
+
+// extractFromIndex only reads the frames of the needed entries, starting from the given one. Instead of verifying the whole file,
+// it relies on the macsum of the index, and on the hashes it contains for the content of each file
+func extractFromIndex(ctx context.Context, backup *backupFile, opts archive.RestoreOptions, from int, log Logger) (archive.RestoreStats, error) {
+	index, err := backup.ReadIndex()
+	if err != nil {
+		return archive.RestoreStats{}, err
+	}
+
+	log.Printf("Extracting...")
+	if !opts.InPlace && !opts.DryRun {
+		os.Mkdir(opts.Destination, os.ModePerm)
+	}
+
+	restorer := archive.NewRestorer(opts, index.Roots)
+	restorer.SetTotal(restoreTotal(index, opts.Filter, from))
+	defer restorer.Finish()
+	for i, entry := range index.Entries[from:] {
+		i += from
+		if err := ctx.Err(); err != nil {
+			return restorer.Stats(), err
+		}
+		if opts.Filter.Match(entry.Name) {
+			var reader io.ReadCloser
+			open := func() (io.Reader, error) {
+				var err error
+				reader, err = backup.OpenEntry(index, i)
+				return reader, err
+			}
+			err := restorer.UntarEntry(ctx, entry, open)
+			if reader != nil {
+				reader.Close()
+			}
+			if err != nil {
+				return restorer.Stats(), err
+			}
+		}
+		if opts.Checkpoint != nil {
+			opts.Checkpoint(i + 1)
+		}
 	}
-	return fileN, folderN
+	return restorer.Stats(), nil
 }
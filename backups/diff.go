@@ -0,0 +1,35 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"context"
+)
+
+// SnapshotBackup returns the entries of the backup, together with the hashes of their content.
+// The index is used if the backup has one, otherwise the whole archive is verified and read
+func SnapshotBackup(path string, privKey []byte, filter *archive.Filter, log Logger) (*archive.Snapshot, error) {
+	backup, err := openBackup(path, privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer backup.Close()
+
+	index, err := backup.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		return archive.NewSnapshot(index.Entries, filter), nil
+	}
+
+	if err := backup.Verify(context.Background(), nil, orDiscard(log)); err != nil {
+		return nil, err
+	}
+	reader, err := backup.Archive()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return archive.ReadSnapshot(reader, filter)
+}
@@ -0,0 +1,47 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoDestination  = errors.New("no destination available")
+	ErrBackupFailed   = errors.New("the backup failed")
+	ErrNotEnoughSpace = errors.New("not enough space")
+	ErrTampered       = errors.New("the file has been tampered with")
+	ErrCorrupted      = errors.New("invalid checksum. The file is corrupted") // The only failure which can't be resumed from, when replicating
+	ErrNewerVersion   = errors.New("this backup has been created by a newer version of the program")
+	ErrInvalidOptions = errors.New("invalid options")
+)
+
+// DestinationError is a failure of a single destination
+type DestinationError struct {
+	Destination string
+	Err         error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Destination, e.Err)
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// Logger receives the messages describing what is being done, one per call. *log.Logger can be used directly
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...any) {}
+
+// orDiscard returns a Logger which drops the messages if none has been set
+func orDiscard(logger Logger) Logger {
+	if logger == nil {
+		return discardLogger{}
+	}
+	return logger
+}
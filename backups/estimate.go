@@ -0,0 +1,84 @@
+package backups
+
+import (
+	"backupusb/storage"
+	"strconv"
+	"time"
+)
+
+// ESTIMATE_MARGIN is added to the size of the previous backup, since the files may have grown in the meantime
+const ESTIMATE_MARGIN = 0.1
+
+// Estimate is how much space a new backup needs in a destination, and how much it has
+type Estimate struct {
+	Input    int64     // Size of the files to back up
+	Previous int64     // Size of the newest backup in the destination, 0 if there's none
+	Needed   int64     // Expected size of the new backup
+	Free     int64     // Space left in the destination, -1 if unknown
+	Prunable []Removal // Backups that the retention will remove once the new one is stored, oldest first
+}
+
+// EstimateBackup guesses the size of the new backup from the previous one, since backups of the same paths are usually similar.
+// Without a previous backup, nothing is assumed to be compressed
+func EstimateBackup(dest storage.Destination, retention Retention, input int64) (*Estimate, error) {
+	files, _, err := listBackups(dest, retention.Legacy)
+	if err != nil {
+		return nil, err
+	}
+	e := &Estimate{Input: input, Needed: input, Free: freeSpace(dest)}
+	var previous *storage.Info
+	for i := range files {
+		if previous == nil || files[i].Name > previous.Name {
+			previous = &files[i]
+		}
+	}
+	if previous != nil {
+		e.Previous = previous.Size
+		e.Needed = min(previous.Size+int64(float64(previous.Size)*ESTIMATE_MARGIN), input)
+	}
+
+	// What the retention would remove right after the new backup
+	free := int64(-1)
+	if e.Free != -1 {
+		free = e.Free - e.Needed
+	}
+	now := time.Now()
+	next := storage.Info{Name: strconv.FormatInt(now.UnixMilli(), 10), Size: e.Needed, ModTime: now}
+	e.Prunable = retention.Plan(append(files, next), free, now)
+	return e, nil
+}
+
+// Fits tells if there's enough space for the new backup (always true if the free space is unknown)
+func (e *Estimate) Fits() bool {
+	return e.Free == -1 || e.Free >= e.Needed
+}
+
+// Reclaimable returns the space which the retention would free
+func (e *Estimate) Reclaimable() int64 {
+	size := int64(0)
+	for _, removal := range e.Prunable {
+		size += removal.Size
+	}
+	return size
+}
+
+// FitsAfterPruning tells if there's enough space once the retention removes the older backups
+func (e *Estimate) FitsAfterPruning() bool {
+	return e.Free == -1 || e.Free+e.Reclaimable() >= e.Needed
+}
+
+// MakeRoom removes the oldest of the backups that the retention would remove anyway, only as many as needed for the new backup to fit
+func (e *Estimate) MakeRoom(dest storage.Destination) []Removal {
+	removed := []Removal{}
+	for _, removal := range e.Prunable {
+		if e.Fits() {
+			break
+		}
+		removal.Err = removeBackup(dest, removal.Name)
+		if removal.Err == nil {
+			e.Free += removal.Size
+		}
+		removed = append(removed, removal)
+	}
+	return removed
+}
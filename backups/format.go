@@ -0,0 +1,292 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"backupusb/compression"
+	"backupusb/crypto"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Backups created before the preamble was introduced start directly with the macsum (version 0).
+// Since version 3 the macsum is at the end of the file, so that it can be written without seeking.
+// Version 4 added the key check, which older versions would mistake for the data
+const MAGIC = "BUSB"
+const FORMAT_VERSION = 4
+const PREAMBLE_SIZE = len(MAGIC) + 3 // Magic, version, flags and codec (version 1 didn't have the codec, and was always zstd)
+const TRAILER_SIZE = 8 + 8 + crypto.MACSUM_SIZE
+
+const (
+	FLAG_INDEX      byte = 1 << iota // The data is split in independent frames, and followed by an encrypted index
+	FLAG_DICTIONARY                  // The data starts with the (encrypted) zstd dictionary the frames have been compressed with
+	FLAG_CHECKSUM                    // The file ends with a checksum of everything before it, after the macsum
+	FLAG_KEY_CHECK                   // The encrypted header is followed by its key check, so that a wrong private key isn't mistaken for a tampered file
+)
+
+const MAX_DICTIONARY_SECTION = 1 << 20 // Trained dictionaries are way smaller, anything bigger means the file is corrupted
+
+const indexMacContext = "BackupUSB index" // Keeps the mac of the index distinct from the one of the whole file
+
+func newPreamble(flags byte, codec compression.Codec) []byte {
+	return append([]byte(MAGIC), FORMAT_VERSION, flags, byte(codec))
+}
+
+// * Dictionary
+
+// dumpDictionary prefixes the dictionary with its size, so that it can be read back before the frames
+func dumpDictionary(dict []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(dict))), dict...)
+}
+
+func readDictionary(in io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(in, size); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size)
+	if n > MAX_DICTIONARY_SECTION {
+		return nil, fmt.Errorf("invalid dictionary size. It seems like %w", ErrTampered)
+	}
+
+	dict := make([]byte, n)
+	if _, err := io.ReadFull(in, dict); err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
+
+// * Trailer
+
+// trailer is stored, not encrypted, at the end of the file, and tells where the index starts
+type trailer struct {
+	IndexOffset int64 // From the start of the data, which is also where the index ends
+	IndexSize   int64
+	IndexMac    []byte
+}
+
+func (t *trailer) Dump() []byte {
+	b := make([]byte, 0, TRAILER_SIZE)
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.IndexOffset))
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.IndexSize))
+	return append(b, t.IndexMac...)
+}
+
+func parseTrailer(in []byte) (*trailer, error) {
+	if len(in) != TRAILER_SIZE {
+		return nil, errors.New("invalid trailer")
+	}
+
+	return &trailer{
+		IndexOffset: int64(binary.LittleEndian.Uint64(in[:8])),
+		IndexSize:   int64(binary.LittleEndian.Uint64(in[8:16])),
+		IndexMac:    in[16:],
+	}, nil
+}
+
+// indexMac authenticates the (compressed) index on its own, so that it can be trusted without reading the whole file
+func indexMac(macKey []byte, offset int64, index []byte) []byte {
+	mac := crypto.NewMAC(macKey)
+	mac.Write([]byte(indexMacContext))
+	mac.Write(binary.LittleEndian.AppendUint64(nil, uint64(offset)))
+	mac.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(index))))
+	mac.Write(index)
+	return mac.Sum(nil)
+}
+
+func encodeIndex(index *archive.Index) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(index); err != nil {
+		return nil, err
+	}
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(buf.Bytes(), nil), nil
+}
+
+func decodeIndex(data []byte) (*archive.Index, error) {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	data, err = decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var index archive.Index
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// * Frames
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// frameStats tracks how much time the compression took, and how much space it saved
+type frameStats struct {
+	Frames int
+	In     int64
+	Out    int64
+	Time   time.Duration
+}
+
+// frameWriter writes the archive as a series of independent frames, keeping track of where each one is.
+// Most frames are compressed by the workers of archive.Tar, the others are compressed while being written
+type frameWriter struct {
+	out      *countingWriter
+	settings compression.Settings
+	encoders [2]compression.Encoder // Normal and stored, for the frames compressed while writing them
+	current  int
+	open     bool // A frame is being compressed while writing it
+	frames   []archive.Frame
+	stats    [2]frameStats
+}
+
+const (
+	framesCompressed = 0
+	framesStored     = 1
+)
+
+func newFrameWriter(out io.Writer, settings compression.Settings) *frameWriter {
+	return &frameWriter{
+		out:      &countingWriter{w: out},
+		settings: settings,
+	}
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	startTime := time.Now()
+	n, err := w.encoders[w.current].Write(p)
+	w.stats[w.current].In += int64(n)
+	w.stats[w.current].Time += time.Since(startTime)
+	return n, err
+}
+
+func (w *frameWriter) endFrame() error {
+	if !w.open {
+		return nil
+	}
+	w.open = false
+
+	startTime := time.Now()
+	if err := w.encoders[w.current].Close(); err != nil {
+		return err
+	}
+
+	last := &w.frames[len(w.frames)-1]
+	last.Size = w.out.n - last.Offset
+
+	stats := &w.stats[w.current]
+	stats.Time += time.Since(startTime)
+	stats.Out += last.Size
+	stats.Frames++
+	return nil
+}
+
+func kind(store bool) int {
+	if store {
+		return framesStored
+	}
+	return framesCompressed
+}
+
+func (w *frameWriter) NewFrame(store bool) (int, error) {
+	if err := w.endFrame(); err != nil {
+		return 0, err
+	}
+
+	// Some encoders already write their header when created or reset, which belongs to the new frame
+	w.frames = append(w.frames, archive.Frame{Offset: w.out.n})
+
+	// Switch to the right encoder
+	w.current = kind(store)
+	if w.encoders[w.current] == nil {
+		settings := w.settings
+		settings.Store = store
+		encoder, err := compression.NewEncoder(w.out, settings)
+		if err != nil {
+			return 0, err
+		}
+		w.encoders[w.current] = encoder
+	} else {
+		w.encoders[w.current].Reset(w.out)
+	}
+
+	w.open = true
+	return len(w.frames) - 1, nil
+}
+
+// NewEncoder is used by the workers, which already run in parallel, so it only uses one goroutine
+func (w *frameWriter) NewEncoder(store bool) (archive.FrameEncoder, error) {
+	settings := w.settings
+	settings.Store = store
+	settings.Concurrency = 1
+	return compression.NewEncoder(io.Discard, settings) // Reset before every frame
+}
+
+func (w *frameWriter) AppendFrame(frame archive.CompressedFrame) (int, error) {
+	if err := w.endFrame(); err != nil {
+		return 0, err
+	}
+
+	offset := w.out.n
+	if _, err := w.out.Write(frame.Data); err != nil {
+		return 0, err
+	}
+	w.frames = append(w.frames, archive.Frame{Offset: offset, Size: int64(len(frame.Data))})
+
+	stats := &w.stats[kind(frame.Store)]
+	stats.Frames++
+	stats.In += frame.In
+	stats.Out += int64(len(frame.Data))
+	stats.Time += frame.Time
+	return len(w.frames) - 1, nil
+}
+
+// Close ends the last frame. The total size of the frames is left in out.n
+func (w *frameWriter) Close() error {
+	return w.endFrame()
+}
+
+// Report describes how the time spent compressing compares to the space saved, for both kinds of frames
+func (w *frameWriter) Report() string {
+	compressed, stored := w.stats[framesCompressed], w.stats[framesStored]
+	report := fmt.Sprintf("Compressed %s into %s in %v", archive.FormatByteCount(compressed.In), archive.FormatByteCount(compressed.Out), compressed.Time.Round(time.Millisecond))
+	if stored.Frames == 0 {
+		return report
+	}
+
+	report += fmt.Sprintf(
+		"\n%d files were already compressed: %s stored as %s in %v",
+		stored.Frames, archive.FormatByteCount(stored.In), archive.FormatByteCount(stored.Out), stored.Time.Round(time.Millisecond),
+	)
+	if compressed.In > 0 { // Estimate how long it would have taken with the normal compression
+		estimate := time.Duration(float64(compressed.Time) / float64(compressed.In) * float64(stored.In))
+		report += fmt.Sprintf(" (instead of ~%v)", estimate.Round(time.Millisecond))
+	}
+	return report
+}
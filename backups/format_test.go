@@ -0,0 +1,208 @@
+package backups
+
+import (
+	"archive/tar"
+	"backupusb/archive"
+	"backupusb/compression"
+	"backupusb/crypto"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeOldBackup writes the files in the format of an older version, without an index: the macsum follows the preamble
+// up to version 2, and is at the end of the file, followed by the checksum, since version 3
+func writeOldBackup(t *testing.T, version byte, pubKey [crypto.PUB_KEY_SIZE]byte, files map[string][]byte) string {
+	t.Helper()
+	archived := bytes.Buffer{}
+	tarWriter := tar.NewWriter(&archived)
+	for name, content := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: "source/" + name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write(content)
+	}
+	tarWriter.Close()
+
+	// Versions 0 and 1 were always zstd
+	codec := compression.CODEC_ZSTD
+	if version >= 2 {
+		codec = compression.CODEC_GZIP
+	}
+	compressed := bytes.Buffer{}
+	encoder, err := compression.NewEncoder(&compressed, compression.Settings{Codec: codec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write(archived.Bytes())
+	encoder.Close()
+
+	header, enHeader, err := crypto.GenHeader(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := bytes.Buffer{}
+	aesWriter, _ := crypto.NewAesWriter(header.AesKey, header.IV, &encrypted)
+	aesWriter.Write(compressed.Bytes())
+
+	var preamble []byte
+	switch version { // Version 0 didn't have a preamble
+	case 1:
+		preamble = append([]byte(MAGIC), 1, 0) // Without the codec
+	case 2:
+		preamble = append([]byte(MAGIC), 2, 0, byte(codec))
+	case 3:
+		preamble = append([]byte(MAGIC), 3, FLAG_CHECKSUM, byte(codec))
+	}
+	mac := crypto.NewMAC(header.MacKey)
+	mac.Write(preamble)
+	mac.Write(enHeader.Dump())
+	mac.Write(encrypted.Bytes())
+
+	file := bytes.Buffer{}
+	file.Write(preamble)
+	if version < 3 {
+		file.Write(mac.Sum(nil))
+	}
+	file.Write(enHeader.Dump())
+	file.Write(encrypted.Bytes())
+	if version >= 3 {
+		file.Write(mac.Sum(nil))
+		checksum := crypto.NewChecksum()
+		checksum.Write(file.Bytes())
+		file.Write(checksum.Sum(nil))
+	}
+
+	path := filepath.Join(t.TempDir(), "1700000000000")
+	if err := os.WriteFile(path, file.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Every version of the format can still be restored, and tampering with any of them is detected
+func TestFormatVersions(t *testing.T) {
+	files := map[string][]byte{"a.txt": []byte("first file"), "b.txt": bytes.Repeat([]byte("second file "), 1000)}
+	privKey, pubKey, err := crypto.GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for version := byte(0); version <= FORMAT_VERSION; version++ {
+		var backup string
+		key := privKey[:]
+		if version < FORMAT_VERSION {
+			backup = writeOldBackup(t, version, pubKey, files)
+		} else {
+			source := filepath.Join(t.TempDir(), "source")
+			os.Mkdir(source, 0700)
+			for name, content := range files {
+				os.WriteFile(filepath.Join(source, name), content, 0600)
+			}
+			backup, key = createTestBackup(t, source, compression.CODEC_ZSTD)
+		}
+
+		t.Chdir(t.TempDir())
+		if _, err := Restore(context.Background(), RestoreOptions{Backup: backup, PrivateKey: key, TarOnly: true}); err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		checkTar(t, filepath.Base(backup)+".tar", files)
+
+		// A byte of the data changed
+		data, _ := os.ReadFile(backup)
+		data[len(data)-200] ^= 1
+		tampered := filepath.Join(t.TempDir(), filepath.Base(backup))
+		os.WriteFile(tampered, data, 0600)
+		if _, err := Restore(context.Background(), RestoreOptions{Backup: tampered, PrivateKey: key, TarOnly: true}); !errors.Is(err, ErrTampered) {
+			t.Fatalf("version %d: restoring a modified backup returned %v, want ErrTampered", version, err)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1700000000000")
+	data := append(append([]byte(MAGIC), FORMAT_VERSION+1, 0, 0), make([]byte, 20000)...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBackup(path, make([]byte, crypto.PRIV_KEY_SIZE)); !errors.Is(err, ErrNewerVersion) {
+		t.Fatalf("opening a backup of a newer version returned %v, want ErrNewerVersion", err)
+	}
+}
+
+// A wrong private key is told apart from a modified backup, since version 4
+func TestWrongKey(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	os.Mkdir(source, 0700)
+	os.WriteFile(filepath.Join(source, "a.txt"), []byte("content"), 0600)
+	backup, _ := createTestBackup(t, source, compression.CODEC_ZSTD)
+
+	otherKey, _, err := crypto.GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBackup(backup, otherKey[:]); !errors.Is(err, crypto.ErrWrongKey) {
+		t.Fatalf("opening the backup with another key returned %v, want ErrWrongKey", err)
+	}
+}
+
+// The frames streamed and the ones appended can all be decompressed on their own, from their offset in the output
+func TestFrameWriter(t *testing.T) {
+	for _, name := range compression.Names() {
+		codec, _ := compression.Parse(name)
+		out := bytes.Buffer{}
+		w := newFrameWriter(&out, compression.Settings{Codec: codec})
+		want := [][]byte{}
+
+		for i, store := range []bool{false, true, false, false} {
+			content := bytes.Repeat([]byte{byte('a' + i)}, 1000*(i+1))
+			want = append(want, content)
+			if i == 2 { // Compressed by a worker
+				encoder, err := w.NewEncoder(store)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data := bytes.Buffer{}
+				encoder.Reset(&data)
+				encoder.Write(content)
+				encoder.Close()
+				if n, err := w.AppendFrame(archive.CompressedFrame{Data: data.Bytes(), Store: store, In: int64(len(content))}); err != nil || n != i {
+					t.Fatalf("%s: appended frame %d (%v), want %d", name, n, err, i)
+				}
+				continue
+			}
+			if n, err := w.NewFrame(store); err != nil || n != i {
+				t.Fatalf("%s: started frame %d (%v), want %d", name, n, err, i)
+			}
+			w.Write(content[:10]) // In more than one write
+			w.Write(content[10:])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(w.frames) != len(want) || w.out.n != int64(out.Len()) {
+			t.Fatalf("%s: %d frames in %d bytes, want %d in %d", name, len(w.frames), w.out.n, len(want), out.Len())
+		}
+		end := int64(0)
+		for i, frame := range w.frames {
+			if frame.Offset != end {
+				t.Fatalf("%s: frame %d starts at %d, right after the previous one at %d", name, i, frame.Offset, end)
+			}
+			end = frame.Offset + frame.Size
+			decoder, err := compression.NewDecoder(bytes.NewReader(out.Bytes()[frame.Offset:end]), compression.Settings{Codec: codec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(decoder)
+			decoder.Close()
+			if err != nil || !bytes.Equal(got, want[i]) {
+				t.Fatalf("%s: frame %d read back as %d bytes (%v), want %d", name, i, len(got), err, len(want[i]))
+			}
+		}
+	}
+}
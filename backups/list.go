@@ -0,0 +1,46 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"context"
+)
+
+// ListBackup uses the index of the backup if it has one, otherwise the whole archive is verified and read
+func ListBackup(path string, privKey []byte, filter *archive.Filter, log Logger, fn func(archive.Entry)) (fileN, folderN uint64, err error) {
+	backup, err := openBackup(path, privKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer backup.Close()
+
+	index, err := backup.ReadIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	if index != nil {
+		for _, entry := range index.Entries {
+			if !filter.Match(entry.Name) {
+				continue
+			}
+
+			if entry.IsDir {
+				folderN++
+			} else {
+				fileN++
+			}
+			fn(entry.Entry)
+		}
+		return fileN, folderN, nil
+	}
+
+	if err := backup.Verify(context.Background(), nil, orDiscard(log)); err != nil {
+		return 0, 0, err
+	}
+	reader, err := backup.Archive()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+
+	return archive.List(reader, filter, fn)
+}
@@ -0,0 +1,192 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Frames decompressed by the workers are kept in memory until they are read (up to archive.DEFAULT_MEMORY_LIMIT in total),
+// bigger ones are decompressed while reading them
+const MAX_PARALLEL_FRAME = 16 << 20
+
+// Rough size of the tar headers and padding of an entry, on top of its content
+const entryOverhead = 4 << 10
+
+// frameJob is a frame of the archive, decompressed either by a worker or, if too big, by the reader itself
+type frameJob struct {
+	frame  archive.Frame
+	size   int64 // Estimated size once decompressed
+	stream bool
+	result chan frameResult
+}
+
+type frameResult struct {
+	data []byte
+	err  error
+}
+
+// parallelReader decompresses the independent frames of the archive concurrently, returning them in order
+type parallelReader struct {
+	backup  *backupFile
+	budget  *archive.Budget // Bounds the frames decompressed but not read yet, whatever the number of cpus
+	queue   chan *frameJob  // Every frame, in order
+	jobs    chan *frameJob  // The frames for the workers
+	stopped chan struct{}
+	stop    func()
+	wg      sync.WaitGroup
+
+	current  io.Reader
+	reserved int64         // Memory reserved for the frame being read
+	decoder  io.ReadCloser // Only while streaming a big frame
+}
+
+// parallelArchive spreads the decompression of the archive across every cpu
+func (b *backupFile) parallelArchive(index *archive.Index) io.ReadCloser {
+	workers := runtime.NumCPU()
+	r := &parallelReader{
+		backup:  b,
+		budget:  archive.NewBudget(archive.DEFAULT_MEMORY_LIMIT),
+		queue:   make(chan *frameJob, 2*workers),
+		jobs:    make(chan *frameJob, workers),
+		stopped: make(chan struct{}),
+		current: bytes.NewReader(nil),
+	}
+	r.stop = sync.OnceFunc(func() {
+		close(r.stopped)
+		r.budget.Stop()
+	})
+
+	r.wg.Add(1 + workers)
+	go r.produce(index)
+	for range workers {
+		go r.work()
+	}
+	return r
+}
+
+// frameSizes estimates how big each frame is once decompressed, from the entries it contains
+func frameSizes(index *archive.Index) []int64 {
+	sizes := make([]int64, len(index.Frames))
+	for _, entry := range index.Entries {
+		if entry.Frame >= 0 && entry.Frame < len(sizes) {
+			sizes[entry.Frame] += entry.Size + entryOverhead
+		}
+	}
+	return sizes
+}
+
+func (r *parallelReader) produce(index *archive.Index) {
+	defer r.wg.Done()
+	defer close(r.jobs)
+	defer close(r.queue)
+
+	sizes := frameSizes(index)
+	for i, frame := range index.Frames {
+		if frame.Size == 0 {
+			continue
+		}
+		job := &frameJob{frame: frame, size: max(sizes[i], entryOverhead), result: make(chan frameResult, 1)}
+		job.stream = job.size > MAX_PARALLEL_FRAME
+
+		// The memory is reserved in order, so that the frame the reader is waiting for always gets it first
+		if !job.stream && !r.budget.Acquire(job.size) {
+			return
+		}
+		select {
+		case r.queue <- job:
+		case <-r.stopped:
+			return
+		}
+		if !job.stream {
+			select {
+			case r.jobs <- job:
+			case <-r.stopped:
+				return
+			}
+		}
+	}
+}
+
+func (r *parallelReader) work() {
+	defer r.wg.Done()
+	for job := range r.jobs {
+		select {
+		case <-r.stopped:
+			job.result <- frameResult{err: errors.New("the archive has been closed")}
+			continue
+		default:
+		}
+
+		decoder, err := r.backup.decompressWith(job.frame.Offset, job.frame.Size, 1) // The frames are already decompressed in parallel
+		if err != nil {
+			job.result <- frameResult{err: err}
+			continue
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, job.size))
+		_, err = io.Copy(buf, decoder)
+		decoder.Close()
+		job.result <- frameResult{data: buf.Bytes(), err: err}
+	}
+}
+
+// next moves to the following frame. Returns io.EOF after the last one
+func (r *parallelReader) next() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+		r.decoder = nil
+	}
+	r.budget.Release(r.reserved)
+	r.reserved = 0
+
+	job, ok := <-r.queue
+	if !ok {
+		return io.EOF
+	}
+	if job.stream {
+		decoder, err := r.backup.decompressWith(job.frame.Offset, job.frame.Size, 0)
+		if err != nil {
+			return err
+		}
+		r.decoder, r.current = decoder, decoder
+		return nil
+	}
+
+	r.reserved = job.size
+	result := <-job.result
+	if result.err != nil {
+		return result.err
+	}
+	r.current = bytes.NewReader(result.data)
+	return nil
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.current.Read(p)
+		if n > 0 && err == io.EOF { // Some decoders return the end of their frame with its last bytes, which isn't the end of the archive
+			return n, nil
+		}
+		if err != io.EOF || n > 0 {
+			return n, err
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close stops the workers, and waits for them to finish
+func (r *parallelReader) Close() error {
+	r.stop()
+	for range r.queue { // Unblocks the producer
+	}
+	r.wg.Wait()
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"backupusb/crypto"
+	"backupusb/storage"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ErrNoChecksum is returned for backups created before the checksum was introduced, which can only be verified with the private key
+var ErrNoChecksum = errors.New("the backup has no checksum")
+
+var errNotBackup = errors.New("not a backup")
+
+type ReplicateStats struct {
+	Copied  int
+	Present int // Already in the destination
+	Failed  int
+	Removed int // By the retention of the destination
+}
+
+// checksumOffset reads the preamble of the backup, returning where its checksum starts
+func checksumOffset(object storage.Object) (int64, error) {
+	preamble := make([]byte, PREAMBLE_SIZE)
+	if _, err := io.ReadFull(io.NewSectionReader(object, 0, int64(PREAMBLE_SIZE)), preamble); err != nil {
+		return 0, errNotBackup
+	}
+	if string(preamble[:len(MAGIC)]) != MAGIC {
+		return 0, errNotBackup // Or a backup from before the preamble, which can't be told apart from any other file
+	}
+
+	version, flags := preamble[len(MAGIC)], preamble[len(MAGIC)+1]
+	if version > FORMAT_VERSION {
+		return 0, ErrNewerVersion
+	}
+	if version < 3 || flags&FLAG_CHECKSUM == 0 {
+		return 0, ErrNoChecksum
+	}
+
+	offset := object.Size() - crypto.CHECKSUM_SIZE
+	if offset < int64(PREAMBLE_SIZE) {
+		return 0, errors.New("the backup is truncated")
+	}
+	return offset, nil
+}
+
+// skipWriter drops what has already been written by an interrupted copy
+type skipWriter struct {
+	out  io.Writer
+	skip int64
+}
+
+func (w *skipWriter) Write(p []byte) (int, error) {
+	n := min(int64(len(p)), w.skip)
+	w.skip -= n
+	if _, err := w.out.Write(p[n:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// copyVerified copies the backup to out, verifying its checksum on the way. The first skip bytes are only verified, since they
+// have already been copied by an interrupted run. Backups without a checksum are copied as they are
+func copyVerified(object storage.Object, out io.Writer, skip int64) (verified bool, err error) {
+	offset, err := checksumOffset(object)
+	if errors.Is(err, ErrNoChecksum) {
+		_, err = io.Copy(out, io.NewSectionReader(object, skip, object.Size()-skip))
+		return false, err
+	} else if err != nil {
+		return false, err
+	}
+
+	checksum := crypto.NewChecksum()
+	rest := &skipWriter{out: out, skip: skip}
+	if _, err := io.Copy(io.MultiWriter(rest, checksum), io.NewSectionReader(object, 0, offset)); err != nil {
+		return false, err
+	}
+	expected := make([]byte, crypto.CHECKSUM_SIZE)
+	if _, err := io.ReadFull(io.NewSectionReader(object, offset, crypto.CHECKSUM_SIZE), expected); err != nil {
+		return false, err
+	}
+	if !crypto.CompareMacSums(checksum.Sum(nil), expected) {
+		return false, ErrCorrupted
+	}
+	_, err = rest.Write(expected)
+	return true, err
+}
+
+// VerifyChecksum reads the backup back from the destination, checking that it has been stored exactly as it was written
+func VerifyChecksum(dest storage.Destination, name string) error {
+	object, err := dest.Open(name)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	verified, err := copyVerified(object, io.Discard, 0)
+	if err == nil && !verified {
+		return ErrNoChecksum
+	}
+	return err
+}
+
+// checkpointWriter makes the destination store the upload every RESUME_CHUNK bytes, saving how much of it can be resumed from
+type checkpointWriter struct {
+	upload   storage.ResumableUpload
+	unsynced int64
+	save     func(offset int64) error
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.upload.Write(p)
+	w.unsynced += int64(n)
+	if err != nil || w.unsynced < RESUME_CHUNK {
+		return n, err
+	}
+
+	offset, err := w.upload.Sync()
+	if err != nil {
+		return n, err
+	}
+	w.unsynced = 0
+	return n, w.save(offset)
+}
+
+// replicateBackup copies a single backup, which is only kept in the destination once verified
+func replicateBackup(src, dest storage.Destination, name string, state *resumeState, log Logger) (verified bool, resumed int64, err error) {
+	object, err := src.Open(name)
+	if err != nil {
+		return false, 0, err
+	}
+	defer object.Close()
+
+	// Only create the copy if it's actually a backup
+	if _, err := checksumOffset(object); err != nil && !errors.Is(err, ErrNoChecksum) {
+		return false, 0, err
+	}
+
+	resumable, ok := dest.(storage.Resumable)
+	if !ok {
+		out, err := dest.Create(name)
+		if err != nil {
+			return false, 0, err
+		}
+		if verified, err = copyVerified(object, out, 0); err != nil {
+			out.Abort()
+			return false, 0, err
+		}
+		return verified, 0, out.Close()
+	}
+
+	// Continue the interrupted upload, if it's still there
+	key := src.String() + "/" + name + " -> " + dest.String()
+	var upload storage.ResumableUpload
+	if checkpoint, ok := state.Uploads[key]; ok && checkpoint.Size == object.Size() && checkpoint.Offset > 0 {
+		if upload, err = resumable.ResumeUpload(name, checkpoint.Offset); err == nil {
+			resumed = checkpoint.Offset
+		} else {
+			log.Printf("  Can't resume the upload of %s, starting over: %v", name, err)
+		}
+	}
+	if upload == nil {
+		if upload, err = resumable.CreateResumable(name); err != nil {
+			return false, 0, err
+		}
+	}
+
+	checkpoint := &uploadCheckpoint{Size: object.Size(), Offset: resumed}
+	state.Uploads[key] = checkpoint
+	out := &checkpointWriter{upload: upload, save: func(offset int64) error {
+		checkpoint.Offset = offset
+		return state.save()
+	}}
+	if err := state.save(); err != nil {
+		upload.Abort()
+		return false, 0, err
+	}
+
+	verified, err = copyVerified(object, out, resumed)
+	if err == nil {
+		err = upload.Close()
+	}
+	if errors.Is(err, ErrCorrupted) {
+		upload.Abort()
+	} else if err != nil {
+		upload.Pause() // Resumed by the next run
+		return false, resumed, err
+	}
+	delete(state.Uploads, key)
+	return verified, resumed, errors.Join(err, state.save())
+}
+
+// Replicate copies the backups of src which are missing from dest, verifying their checksums on the way, without needing the private key.
+// Only the backups kept by the retention are copied, and the retention is then applied to dest
+func Replicate(src, dest storage.Destination, retention Retention, logger Logger) (ReplicateStats, error) {
+	log := orDiscard(logger)
+	stats := ReplicateStats{}
+	files, _, err := listBackups(src, false) // The legacy backups have no checksum to verify the copies with
+	if err != nil {
+		return stats, err
+	}
+	existing, err := dest.List()
+	if err != nil {
+		return stats, err
+	}
+	sizes := make(map[string]int64, len(existing))
+	for _, file := range existing {
+		sizes[file.Name] = file.Size
+	}
+
+	// The others would be removed right away
+	removed := map[string]bool{}
+	for _, removal := range retention.Plan(files, -1, time.Now()) {
+		removed[removal.Name] = true
+	}
+	files = slices.DeleteFunc(files, func(file storage.Info) bool {
+		return removed[file.Name]
+	})
+	sort.SliceStable(files, func(i, j int) bool { // Sort reversed
+		return files[i].Name > files[j].Name
+	})
+
+	state := loadResume()
+	for i := len(files) - 1; i >= 0; i-- { // Oldest first, in the same order they have been created
+		file := files[i]
+		if size, ok := sizes[file.Name]; ok && size == file.Size {
+			log.Printf("= %s", file.Name)
+			stats.Present++
+			continue
+		}
+
+		verified, resumed, err := replicateBackup(src, dest, file.Name, state, log)
+		details := archive.FormatByteCount(file.Size)
+		if resumed > 0 {
+			details += ", resumed from " + archive.FormatByteCount(resumed)
+		}
+		switch {
+		case errors.Is(err, errNotBackup):
+			continue
+		case errors.Is(err, ErrCorrupted):
+			log.Printf("! %s: %v", file.Name, err)
+			stats.Failed++
+		case err != nil:
+			log.Printf("! %s: %v (it will be resumed by the next run)", file.Name, err)
+			stats.Failed++
+		case !verified:
+			log.Printf("+ %s (%s, no checksum to verify)", file.Name, details)
+			stats.Copied++
+		default:
+			log.Printf("+ %s (%s)", file.Name, details)
+			stats.Copied++
+		}
+	}
+
+	// Apply the retention to the destination too
+	removals, skipped, err := Prune(dest, retention, false)
+	if err != nil {
+		return stats, err
+	}
+	if len(skipped) > 0 {
+		log.Printf("! %s", LegacyWarning(len(skipped)))
+	}
+	for _, removal := range removals {
+		if removal.Err != nil {
+			log.Printf("! %s: unable to remove it (%v)", removal.Name, removal.Err)
+			continue
+		}
+		log.Printf("- %s (%s)", removal.Name, removal.Reason)
+		stats.Removed++
+	}
+	return stats, nil
+}
@@ -0,0 +1,91 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"backupusb/storage"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// REPORT_SUFFIX is appended to the name of a backup for the report stored next to it
+const REPORT_SUFFIX = ".json"
+
+// Report is the result of a command, printed with --output json and stored next to each backup if enabled in the config
+type Report struct {
+	Command      string                `json:"command"`
+	Backup       string                `json:"backup,omitempty"` // Name of the backup created, or path of the one read
+	Success      bool                  `json:"success"`
+	Started      time.Time             `json:"started"`
+	Duration     float64               `json:"duration"` // Seconds
+	Files        uint64                `json:"files"`
+	Folders      uint64                `json:"folders"`
+	BytesIn      int64                 `json:"bytes_in"`        // Read: the files backed up, or the backup
+	BytesOut     int64                 `json:"bytes_out"`       // Written: the backup, or the files restored
+	Ratio        float64               `json:"ratio,omitempty"` // Size of the backup compared to the files, when creating it
+	Codec        string                `json:"codec,omitempty"`
+	MAC          string                `json:"mac,omitempty"` // Hex macsum of the backup
+	Destinations []DestinationReport   `json:"destinations,omitempty"`
+	Restore      *archive.RestoreStats `json:"restore,omitempty"`
+	Entries      []archive.Entry       `json:"entries,omitempty"`
+	Errors       []string              `json:"errors"`
+}
+
+// DestinationReport is the result of a backup in one of the destinations
+type DestinationReport struct {
+	Name    string   `json:"name"`
+	File    string   `json:"file,omitempty"` // Where the backup has been stored
+	Ok      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Removed []string `json:"removed,omitempty"` // Older backups removed by the retention
+}
+
+func NewReport(command string) *Report {
+	return &Report{Command: command, Started: time.Now(), Errors: []string{}}
+}
+
+// Fail adds the error to the report
+func (r *Report) Fail(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Finish sets the duration, and the success if there have been no errors
+func (r *Report) Finish() {
+	r.Duration = time.Since(r.Started).Seconds()
+	r.Success = len(r.Errors) == 0
+}
+
+// BackupFile returns the location of a backup in the destination
+func BackupFile(dest storage.Destination, name string) string {
+	return strings.TrimSuffix(dest.String(), "/") + "/" + name
+}
+
+// WriteReport stores the report next to the backup, as <name>.json
+func WriteReport(dest storage.Destination, name string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	upload, err := dest.Create(name + REPORT_SUFFIX)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Write(data); err != nil {
+		upload.Abort()
+		return err
+	}
+	return upload.Close()
+}
+
+// removeBackup removes the backup, together with its report if there's one
+func removeBackup(dest storage.Destination, name string) error {
+	if err := dest.Remove(name); err != nil {
+		return err
+	}
+	if err := dest.Remove(name + REPORT_SUFFIX); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"backupusb/storage"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RESUME_PATH is where the checkpoints of the interrupted uploads and restores are kept, next to the config
+const RESUME_PATH = "resume.json"
+
+// RESUME_CHUNK is how much is uploaded between two checkpoints
+const RESUME_CHUNK = 16 << 20
+
+// Restores save their checkpoint at most this often (unless the files which already exist are renamed)
+const checkpointInterval = time.Second
+
+// uploadCheckpoint is a backup partially copied to another destination
+type uploadCheckpoint struct {
+	Size   int64 // Of the whole backup, to tell if it's still the same
+	Offset int64 // Already stored by the destination
+}
+
+// restoreCheckpoint is a backup partially extracted
+type restoreCheckpoint struct {
+	MacSum  []byte // Identifies the backup
+	Options string // The restore can only be resumed with the same options
+	Entries int    // Entries of the index already restored (or skipped)
+}
+
+// resumeState is the content of the file, keyed by what has been interrupted
+type resumeState struct {
+	Uploads  map[string]*uploadCheckpoint  `json:",omitempty"`
+	Restores map[string]*restoreCheckpoint `json:",omitempty"`
+}
+
+// loadResume reads the checkpoints. A missing or unreadable file simply means that there is nothing to resume
+func loadResume() *resumeState {
+	state := &resumeState{}
+	if data, err := os.ReadFile(RESUME_PATH); err == nil {
+		json.Unmarshal(data, state)
+	}
+	if state.Uploads == nil {
+		state.Uploads = map[string]*uploadCheckpoint{}
+	}
+	if state.Restores == nil {
+		state.Restores = map[string]*restoreCheckpoint{}
+	}
+	return state
+}
+
+// save replaces the file, which is removed once there's nothing left to resume
+func (s *resumeState) save() error {
+	if len(s.Uploads) == 0 && len(s.Restores) == 0 {
+		if err := os.Remove(RESUME_PATH); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data := bytes.Buffer{}
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false) // The keys contain ->
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	if err := os.WriteFile(RESUME_PATH+".tmp", data.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(RESUME_PATH+".tmp", RESUME_PATH) // Never leaves a truncated file behind
+}
+
+// restoreResume keeps the checkpoint of a restore up to date
+type restoreResume struct {
+	state      *resumeState
+	key        string
+	checkpoint *restoreCheckpoint
+	saved      time.Time
+	everyEntry bool
+	log        Logger
+}
+
+// newRestoreResume finds the checkpoint of an interrupted restore of the same backup, to the same destination and with the same options,
+// and makes the restore update it
+func newRestoreResume(path string, macSum []byte, opts *archive.RestoreOptions, log Logger) *restoreResume {
+	destination, _ := filepath.Abs(opts.Destination)
+	options := fmt.Sprintf("in-place=%t conflict=%d", opts.InPlace, opts.Conflict)
+	if !opts.Filter.IsEmpty() {
+		options += fmt.Sprintf(" include=%q exclude=%q", opts.Filter.Include, opts.Filter.Exclude)
+	}
+
+	r := &restoreResume{
+		state:      loadResume(),
+		key:        storage.Redact(path) + " -> " + destination,
+		everyEntry: opts.Conflict == archive.CONFLICT_RENAME, // Restoring a file twice would create a copy of it
+		log:        log,
+	}
+	checkpoint, ok := r.state.Restores[r.key]
+	if !ok || !bytes.Equal(checkpoint.MacSum, macSum) || checkpoint.Options != options {
+		checkpoint = &restoreCheckpoint{MacSum: macSum, Options: options}
+		r.state.Restores[r.key] = checkpoint
+	}
+	r.checkpoint = checkpoint
+	opts.Checkpoint = r.save
+	return r
+}
+
+func (r *restoreResume) save(entries int) {
+	r.checkpoint.Entries = entries
+	if !r.everyEntry && time.Since(r.saved) < checkpointInterval {
+		return
+	}
+	r.saved = time.Now()
+	if err := r.state.save(); err != nil {
+		r.log.Printf("Unable to save the checkpoint of the restore: %v", err)
+	}
+}
+
+// flush saves the latest checkpoint right away, once the restore has been interrupted or has failed
+func (r *restoreResume) flush() {
+	if r == nil {
+		return
+	}
+	if err := r.state.save(); err != nil {
+		r.log.Printf("Unable to save the checkpoint of the restore: %v", err)
+	}
+}
+
+// done forgets the checkpoint, once the restore has been completed
+func (r *restoreResume) done() {
+	if r == nil {
+		return
+	}
+	delete(r.state.Restores, r.key)
+	if err := r.state.save(); err != nil {
+		r.log.Printf("Unable to remove the checkpoint of the restore: %v", err)
+	}
+}
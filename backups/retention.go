@@ -0,0 +1,230 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"backupusb/storage"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention decides which backups are kept in a destination. A backup is kept if any of the keep rules selects it,
+// and then the limits remove the oldest ones. The newest backup is never removed
+type Retention struct {
+	Last    int // The newest backups kept (-1 for all of them)
+	Daily   int // The newest backup of each of the last Daily days which have one
+	Weekly  int
+	Monthly int
+	Yearly  int
+
+	MaxAge  time.Duration // 0 for no limit
+	MaxSize int64         // Of all the backups together, 0 for no limit
+	MinFree int64         // Space left in the destination, 0 for no limit
+
+	Legacy bool // Also apply the rules to the files named like backups but without the magic, the backups from before the preamble (version 0)
+}
+
+// Removal is a backup removed by the retention, and why
+type Removal struct {
+	storage.Info
+	Reason string
+	Err    error // If it couldn't be removed
+}
+
+// calendar tells if any of the daily, weekly, monthly or yearly rules is set
+func (r Retention) calendar() bool {
+	return r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0 || r.Yearly > 0
+}
+
+// Validate checks the rules, which must keep at least one backup
+func (r Retention) Validate() error {
+	if r.Last < -1 || (r.Last == 0 && !r.calendar()) {
+		return fmt.Errorf("invalid backups amount %d. Set it to a positive integer to limit the amount of backups, or to -1 to keep all of them", r.Last)
+	}
+	if r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 || r.Yearly < 0 || r.MaxAge < 0 || r.MaxSize < 0 || r.MinFree < 0 {
+		return errors.New("the retention rules and limits can't be negative")
+	}
+	return nil
+}
+
+// backupTime returns when the backup was created, from its name (unix milliseconds)
+func backupTime(file storage.Info) time.Time {
+	if millis, err := strconv.ParseInt(file.Name, 10, 64); err == nil {
+		return time.UnixMilli(millis)
+	}
+	return file.ModTime
+}
+
+// bucket is a calendar period of a keep rule
+type bucket struct {
+	keep   int
+	period func(t time.Time) string
+	last   string
+}
+
+// Plan returns the backups which should be removed, oldest first. free is the space left in the destination (-1 if unknown)
+func (r Retention) Plan(files []storage.Info, free int64, now time.Time) []Removal {
+	files = append([]storage.Info{}, files...)
+	sort.SliceStable(files, func(i, j int) bool { // Newest first
+		return files[i].Name > files[j].Name
+	})
+
+	buckets := []*bucket{
+		{keep: r.Daily, period: func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{keep: r.Weekly, period: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%d", year, week)
+		}},
+		{keep: r.Monthly, period: func(t time.Time) string { return t.Format("2006-01") }},
+		{keep: r.Yearly, period: func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	reasons := make([]string, len(files)) // Empty if kept
+	for i, file := range files {
+		kept := i == 0 || r.Last == -1 || i < r.Last
+		created := backupTime(file)
+		for _, b := range buckets {
+			if period := b.period(created); b.keep > 0 && period != b.last {
+				b.keep--
+				b.last = period
+				kept = true
+			}
+		}
+		if !kept {
+			reasons[i] = "not kept by any rule"
+		}
+	}
+
+	// The limits go from the oldest backup to the newest one
+	limit := func(reason string, exceeded func(i int) bool) {
+		for i := len(files) - 1; i > 0; i-- {
+			if reasons[i] == "" && exceeded(i) {
+				reasons[i] = reason
+			}
+		}
+	}
+	if r.MaxAge > 0 {
+		limit("older than "+formatDuration(r.MaxAge), func(i int) bool {
+			return now.Sub(backupTime(files[i])) > r.MaxAge
+		})
+	}
+	if r.MaxSize > 0 {
+		total := int64(0)
+		for i, file := range files {
+			if reasons[i] == "" {
+				total += file.Size
+			}
+		}
+		limit("the backups take more than "+archive.FormatByteCount(r.MaxSize), func(i int) bool {
+			if total <= r.MaxSize {
+				return false
+			}
+			total -= files[i].Size
+			return true
+		})
+	}
+	if r.MinFree > 0 && free != -1 {
+		for i, file := range files { // Space which the other rules already free
+			if reasons[i] != "" {
+				free += file.Size
+			}
+		}
+		limit("less than "+archive.FormatByteCount(r.MinFree)+" free", func(i int) bool {
+			if free >= r.MinFree {
+				return false
+			}
+			free += files[i].Size
+			return true
+		})
+	}
+
+	removals := []Removal{}
+	for i := len(files) - 1; i >= 0; i-- {
+		if reasons[i] != "" {
+			removals = append(removals, Removal{Info: files[i], Reason: reasons[i]})
+		}
+	}
+	return removals
+}
+
+func formatDuration(d time.Duration) string {
+	if days := d / (24 * time.Hour); days*24*time.Hour == d {
+		return strconv.Itoa(int(days)) + " days"
+	}
+	return d.String()
+}
+
+// String describes the rules, for the output of prune
+func (r Retention) String() string {
+	rules := []string{}
+	if r.Last == -1 {
+		rules = append(rules, "all the backups")
+	} else if r.Last > 0 {
+		rules = append(rules, fmt.Sprintf("the newest %d", r.Last))
+	}
+	for _, rule := range []struct {
+		amount int
+		period string
+	}{{r.Daily, "daily"}, {r.Weekly, "weekly"}, {r.Monthly, "monthly"}, {r.Yearly, "yearly"}} {
+		if rule.amount > 0 {
+			rules = append(rules, fmt.Sprintf("%d %s", rule.amount, rule.period))
+		}
+	}
+	if len(rules) == 0 {
+		rules = append(rules, "the newest backup")
+	}
+	description := "Keeping " + strings.Join(rules, ", ")
+	if r.MaxAge > 0 {
+		description += ", up to " + formatDuration(r.MaxAge) + " old"
+	}
+	if r.MaxSize > 0 {
+		description += ", up to " + archive.FormatByteCount(r.MaxSize) + " in total"
+	}
+	if r.MinFree > 0 {
+		description += ", leaving " + archive.FormatByteCount(r.MinFree) + " free"
+	}
+	return description
+}
+
+// freeSpace returns the space left in the destination, or -1 if it can't tell
+func freeSpace(dest storage.Destination) int64 {
+	spacer, ok := dest.(storage.FreeSpacer)
+	if !ok {
+		return -1
+	}
+	free, err := spacer.FreeSpace()
+	if err != nil {
+		return -1
+	}
+	return free
+}
+
+// Prune applies the retention to the destination, returning the backups to remove and whether they have been removed,
+// and the legacy backups which have been left alone (unless the retention includes them). With dryRun, nothing is actually removed
+func Prune(dest storage.Destination, retention Retention, dryRun bool) (removals []Removal, skipped []storage.Info, err error) {
+	files, skipped, err := listBackups(dest, retention.Legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removals = retention.Plan(files, freeSpace(dest), time.Now())
+	if !dryRun {
+		for i := range removals {
+			removals[i].Err = removeBackup(dest, removals[i].Name)
+		}
+	}
+	return removals, skipped, nil
+}
+
+// LegacyWarning tells what to do about the legacy backups skipped by the retention
+func LegacyWarning(skipped int) string {
+	found, them := fmt.Sprintf("%d files look like backups", skipped), "them"
+	if skipped == 1 {
+		found, them = "1 file looks like a backup", "it"
+	}
+	return found + " created by an old version (without the " + MAGIC + " magic), never removed by the retention. " +
+		"Remove " + them + " by hand, or check \"Apply the retention to old backups\" in the config"
+}
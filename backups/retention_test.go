@@ -0,0 +1,146 @@
+package backups
+
+import (
+	"backupusb/storage"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionPlan(t *testing.T) {
+	const layout = "2006-01-02 15:04"
+	now, _ := time.ParseInLocation(layout, "2024-06-15 18:00", time.Local) // A saturday
+
+	tests := []struct {
+		name      string
+		retention Retention
+		backups   []string // Every one of them takes 10 bytes
+		free      int64
+		removed   []string // Oldest first
+	}{
+		{
+			name:      "all",
+			retention: Retention{Last: -1},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00", "2020-01-01 12:00"},
+		},
+		{
+			name:      "last",
+			retention: Retention{Last: 2},
+			backups:   []string{"2024-06-12 12:00", "2024-06-15 12:00", "2024-06-13 12:00", "2024-06-14 12:00"}, // In any order
+			removed:   []string{"2024-06-12 12:00", "2024-06-13 12:00"},
+		},
+		{
+			name:      "daily",
+			retention: Retention{Daily: 3},
+			backups:   []string{"2024-06-15 12:00", "2024-06-15 06:00", "2024-06-14 12:00", "2024-06-14 06:00", "2024-06-12 12:00", "2024-06-12 06:00", "2024-06-11 12:00"},
+			removed:   []string{"2024-06-11 12:00", "2024-06-12 06:00", "2024-06-14 06:00", "2024-06-15 06:00"}, // The days without backups don't count
+		},
+		{
+			name:      "weekly",
+			retention: Retention{Weekly: 2},
+			backups:   []string{"2024-06-15 12:00", "2024-06-10 12:00", "2024-06-09 12:00", "2024-06-03 12:00", "2024-06-02 12:00"},
+			removed:   []string{"2024-06-02 12:00", "2024-06-03 12:00", "2024-06-10 12:00"}, // Weeks start on monday
+		},
+		{
+			name:      "monthly and yearly",
+			retention: Retention{Monthly: 2, Yearly: 2},
+			backups:   []string{"2024-06-15 12:00", "2024-06-01 12:00", "2024-05-20 12:00", "2024-05-02 12:00", "2023-12-31 12:00", "2023-06-01 12:00", "2022-07-01 12:00"},
+			removed:   []string{"2022-07-01 12:00", "2023-06-01 12:00", "2024-05-02 12:00", "2024-06-01 12:00"},
+		},
+		{
+			name:      "last and daily",
+			retention: Retention{Last: 1, Daily: 2},
+			backups:   []string{"2024-06-15 12:00", "2024-06-15 06:00", "2024-06-14 12:00", "2024-06-13 12:00"},
+			removed:   []string{"2024-06-13 12:00", "2024-06-15 06:00"},
+		},
+		{
+			name:      "max age",
+			retention: Retention{Last: -1, MaxAge: 30 * 24 * time.Hour},
+			backups:   []string{"2024-06-15 12:00", "2024-05-20 12:00", "2024-05-02 12:00"},
+			removed:   []string{"2024-05-02 12:00"},
+		},
+		{
+			name:      "max age keeps the newest",
+			retention: Retention{Last: -1, MaxAge: 30 * 24 * time.Hour},
+			backups:   []string{"2024-01-01 12:00", "2023-12-01 12:00"},
+			removed:   []string{"2023-12-01 12:00"},
+		},
+		{
+			name:      "max size",
+			retention: Retention{Last: -1, MaxSize: 25},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00", "2024-06-13 12:00", "2024-06-12 12:00"},
+			removed:   []string{"2024-06-12 12:00", "2024-06-13 12:00"},
+		},
+		{
+			name:      "max size without the backups already removed",
+			retention: Retention{Last: 3, MaxSize: 25},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00", "2024-06-13 12:00", "2024-06-12 12:00"},
+			removed:   []string{"2024-06-12 12:00", "2024-06-13 12:00"},
+		},
+		{
+			name:      "min free",
+			retention: Retention{Last: -1, MinFree: 20},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00", "2024-06-13 12:00", "2024-06-12 12:00"},
+			free:      5,
+			removed:   []string{"2024-06-12 12:00", "2024-06-13 12:00"},
+		},
+		{
+			name:      "min free counts the backups already removed",
+			retention: Retention{Last: 3, MinFree: 20},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00", "2024-06-13 12:00", "2024-06-12 12:00"},
+			free:      5,
+			removed:   []string{"2024-06-12 12:00", "2024-06-13 12:00"},
+		},
+		{
+			name:      "min free unknown",
+			retention: Retention{Last: -1, MinFree: 20},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00"},
+			free:      -1,
+		},
+		{
+			name:      "min free keeps the newest",
+			retention: Retention{Last: -1, MinFree: 1000},
+			backups:   []string{"2024-06-15 12:00", "2024-06-14 12:00"},
+			removed:   []string{"2024-06-14 12:00"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := []storage.Info{}
+			for _, backup := range test.backups {
+				created, err := time.ParseInLocation(layout, backup, time.Local)
+				if err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, storage.Info{Name: strconv.FormatInt(created.UnixMilli(), 10), Size: 10})
+			}
+
+			removed := []string{}
+			for _, removal := range test.retention.Plan(files, test.free, now) {
+				millis, _ := strconv.ParseInt(removal.Name, 10, 64)
+				removed = append(removed, time.UnixMilli(millis).Format(layout))
+				if removal.Reason == "" {
+					t.Errorf("no reason given to remove %s", removed[len(removed)-1])
+				}
+			}
+			if !slices.Equal(removed, test.removed) {
+				t.Fatalf("removed %v, want %v", removed, test.removed)
+			}
+		})
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+	for _, retention := range []Retention{{Last: 0}, {Last: -2}, {Last: 1, Daily: -1}, {Last: 1, MaxSize: -1}} {
+		if retention.Validate() == nil {
+			t.Errorf("%+v has been accepted", retention)
+		}
+	}
+	for _, retention := range []Retention{{Last: -1}, {Last: 1}, {Weekly: 4}, {Last: 3, MaxAge: time.Hour, MinFree: 1}} {
+		if err := retention.Validate(); err != nil {
+			t.Errorf("%+v: %v", retention, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package backups
+
+import (
+	"archive/tar"
+	"backupusb/archive"
+	"backupusb/compression"
+	"backupusb/crypto"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTree writes a file bigger than MAX_PARALLEL_FRAME, so that it's streamed instead of decompressed by the workers, and a few small ones
+func testTree(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "source")
+	files := map[string][]byte{}
+
+	big := bytes.Buffer{}
+	for i := 0; big.Len() < MAX_PARALLEL_FRAME+4<<20; i++ {
+		fmt.Fprintf(&big, "line %d of the big file, %x\n", i, i*i)
+	}
+	big.WriteString("the end") // Not aligned with anything
+	files["big.txt"] = big.Bytes()
+	for i := range 5 {
+		files[filepath.Join("folder", fmt.Sprintf("small%d.txt", i))] = bytes.Repeat([]byte{byte('a' + i)}, 1000*i)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, files
+}
+
+// createTestBackup backs up the folder with the codec, returning the path of the backup and the private key to read it
+func createTestBackup(t *testing.T, source string, codec compression.Codec) (string, []byte) {
+	t.Helper()
+	privKey, pubKey, err := crypto.GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	report, err := Create(context.Background(), CreateOptions{
+		PublicKey:    pubKey,
+		Paths:        []string{source},
+		Destinations: []string{dest},
+		Compression:  compression.Settings{Codec: codec},
+		Retention:    Retention{Last: -1},
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	return filepath.Join(dest, report.Backup), privKey[:]
+}
+
+// checkTar reads the whole archive, which must end with its end-of-archive blocks
+func checkTar(t *testing.T, path string, want map[string][]byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%512 != 0 || len(data) < 1024 || !bytes.Equal(data[len(data)-1024:], make([]byte, 1024)) {
+		t.Fatalf("the archive (%d bytes) is truncated", len(data))
+	}
+
+	found := 0
+	r := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("read the archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %s: %v", header.Name, err)
+		}
+		expected, ok := want[filepath.FromSlash(strings.TrimPrefix(header.Name, "source/"))]
+		if !ok {
+			t.Fatalf("unexpected file %s in the archive", header.Name)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Fatalf("content of %s doesn't match", header.Name)
+		}
+		found++
+	}
+	if found != len(want) {
+		t.Fatalf("%d files found in the archive, want %d", found, len(want))
+	}
+}
+
+// checkRestored compares the files restored in dir with the original ones
+func checkRestored(t *testing.T, dir string, want map[string][]byte) {
+	t.Helper()
+	for name, expected := range want {
+		content, err := os.ReadFile(filepath.Join(dir, "source", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Fatalf("content of %s doesn't match", name)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	source, files := testTree(t)
+	for _, name := range compression.Names() {
+		t.Run(name, func(t *testing.T) {
+			codec, _ := compression.Parse(name)
+			backup, privKey := createTestBackup(t, source, codec)
+
+			// Decrypt only, to <name>.tar in the current folder
+			t.Chdir(t.TempDir())
+			stats, err := Restore(context.Background(), RestoreOptions{Backup: backup, PrivateKey: privKey, TarOnly: true})
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			checkTar(t, filepath.Base(backup)+".tar", files)
+			if info, _ := os.Stat(filepath.Base(backup) + ".tar"); info.Size() != stats.Bytes {
+				t.Fatalf("%d bytes written, but the archive has %d", stats.Bytes, info.Size())
+			}
+
+			// Extract every file
+			dest := t.TempDir()
+			_, err = Restore(context.Background(), RestoreOptions{
+				RestoreOptions: archive.RestoreOptions{Destination: dest},
+				Backup:         backup,
+				PrivateKey:     privKey,
+			})
+			if err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			checkRestored(t, filepath.Join(dest, "_"+filepath.Base(backup)), files)
+		})
+	}
+}
+
+// Unchanged files are never replaced by --overwrite-if-newer, whatever the fraction of a second of their modification time,
+// both when extracting the whole archive and when reading the files through the index
+func TestOverwriteIfNewerUnchanged(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	if err := os.Mkdir(source, 0700); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, fraction := range []time.Duration{0, 300 * time.Millisecond, 500 * time.Millisecond, 700 * time.Millisecond, 999 * time.Millisecond} {
+		path := filepath.Join(source, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(path, []byte(path), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, time.Time{}, base.Add(time.Duration(i)*time.Minute+fraction)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, privKey := createTestBackup(t, source, compression.CODEC_ZSTD)
+
+	everything, _ := archive.NewFilter([]string{"**"}, nil)
+	for _, filter := range []*archive.Filter{nil, everything} { // The whole archive, then through the index
+		stats, err := Restore(context.Background(), RestoreOptions{
+			RestoreOptions: archive.RestoreOptions{InPlace: true, Conflict: archive.CONFLICT_OVERWRITE_IF_NEWER, Filter: filter},
+			Backup:         backup,
+			PrivateKey:     privKey,
+		})
+		if err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		if stats.Replaced != 0 || stats.Skipped != 5 {
+			t.Fatalf("filter %v: %d replaced and %d skipped, want 0 and 5", filter != nil, stats.Replaced, stats.Skipped)
+		}
+	}
+}
+
+// A restore failing on its own, and not only when it's interrupted, keeps its checkpoint to be resumed
+func TestRestoreFailureKeepsCheckpoint(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	for _, name := range []string{"a.txt", filepath.Join("folder", "b.txt")} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(source, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, privKey := createTestBackup(t, source, compression.CODEC_ZSTD)
+	t.Chdir(t.TempDir())
+
+	everything, _ := archive.NewFilter([]string{"**"}, nil)
+	for _, filter := range []*archive.Filter{nil, everything} { // The whole archive, then through the index
+		dest := t.TempDir()
+		blocked := filepath.Join(dest, "_"+filepath.Base(backup), "source", "folder") // A file where the folder must be created
+		if err := os.MkdirAll(filepath.Dir(blocked), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(blocked, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := Restore(context.Background(), RestoreOptions{
+			RestoreOptions: archive.RestoreOptions{Destination: dest, Filter: filter},
+			Backup:         backup,
+			PrivateKey:     privKey,
+		})
+		if err == nil {
+			t.Fatalf("filter %v: the restore succeeded", filter != nil)
+		}
+		state := loadResume()
+		if len(state.Restores) != 1 {
+			t.Fatalf("filter %v: %d checkpoints saved, want 1", filter != nil, len(state.Restores))
+		}
+		for _, checkpoint := range state.Restores {
+			if checkpoint.Entries != 2 { // The source folder and a.txt, the first entry being saved right away and the second only when failing
+				t.Fatalf("filter %v: checkpoint after %d entries, want 2", filter != nil, checkpoint.Entries)
+			}
+		}
+		os.Remove(RESUME_PATH)
+	}
+}
+
+// Links are skipped, instead of failing the backup
+func TestSkipLinks(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	if err := os.Mkdir(source, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "file.txt"), []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(source, "link")); err != nil {
+		t.Skipf("unable to create a link: %v", err)
+	}
+
+	size, files, _, err := archive.Size([]string{source})
+	if err != nil || size != 7 || files != 1 {
+		t.Fatalf("size %d of %d files (%v), want 7 bytes in 1 file", size, files, err)
+	}
+	backup, privKey := createTestBackup(t, source, compression.CODEC_ZSTD)
+	t.Chdir(t.TempDir())
+	if _, err := Restore(context.Background(), RestoreOptions{Backup: backup, PrivateKey: privKey, TarOnly: true}); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	checkTar(t, filepath.Base(backup)+".tar", map[string][]byte{"file.txt": []byte("content")})
+}
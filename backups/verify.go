@@ -0,0 +1,96 @@
+package backups
+
+import (
+	"backupusb/archive"
+	"backupusb/crypto"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VerifyResult describes a backup whose integrity has been verified
+type VerifyResult struct {
+	Size     int64
+	Codec    string
+	MAC      []byte
+	Files    uint64 // From the index, if there's one
+	Folders  uint64
+	Indexed  bool // The index has been verified too
+	Checksum bool // The checksum has been verified too (false for backups created before it was introduced)
+}
+
+// sectionWriter only writes the part of the stream between start and end
+type sectionWriter struct {
+	w          io.Writer
+	start, end int64
+	pos        int64
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	from, to := max(s.start-s.pos, 0), min(s.end-s.pos, int64(len(p)))
+	s.pos += int64(len(p))
+	if from < to {
+		if _, err := s.w.Write(p[from:to]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// VerifyBackup checks the macsum of the whole backup, its index and its checksum, reading it only once.
+// Returns what has been verified, or an error matching crypto.ErrWrongKey for the wrong private key, ErrCorrupted if the checksum
+// doesn't match (the file has been damaged), or ErrTampered if the macsum doesn't (the file has been modified)
+func VerifyBackup(path string, privKey []byte, progress archive.ProgressFunc) (*VerifyResult, error) {
+	b, err := openBackup(path, privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	size := b.file.Size()
+	result := &VerifyResult{Size: size, Codec: b.settings.Codec.String(), MAC: b.macSum}
+	checksumEnd, err := checksumOffset(b.file)
+	if err != nil && !errors.Is(err, ErrNoChecksum) {
+		return nil, err
+	}
+	result.Checksum = err == nil
+
+	checksum := crypto.NewChecksum()
+	tracker := archive.NewTracker(archive.STAGE_VERIFY, size, 0, progress)
+	writers := []io.Writer{tracker.Writer(io.Discard), &sectionWriter{w: b.mac, start: b.macStart, end: b.macEnd}}
+	if result.Checksum {
+		writers = append(writers, &sectionWriter{w: checksum, end: checksumEnd})
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), io.NewSectionReader(b.file, 0, size)); err != nil {
+		return nil, err
+	}
+	tracker.Finish()
+
+	if result.Checksum {
+		expected := make([]byte, crypto.CHECKSUM_SIZE)
+		if _, err := io.ReadFull(io.NewSectionReader(b.file, checksumEnd, crypto.CHECKSUM_SIZE), expected); err != nil {
+			return nil, err
+		}
+		if !crypto.CompareMacSums(checksum.Sum(nil), expected) {
+			return nil, ErrCorrupted
+		}
+	}
+	if err := crypto.VerifyMacSum(b.macSum, b.mac.Sum(nil)); err != nil {
+		return nil, fmt.Errorf("%w. It seems like %w", err, ErrTampered)
+	}
+	if b.trailer != nil {
+		index, err := b.ReadIndex()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range index.Entries {
+			if entry.IsDir {
+				result.Folders++
+			} else {
+				result.Files++
+			}
+		}
+		result.Indexed = true
+	}
+	return result, nil
+}
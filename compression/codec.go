@@ -0,0 +1,256 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec is stored in the backup preamble, so the values must never change
+type Codec byte
+
+const (
+	CODEC_ZSTD Codec = iota
+	CODEC_GZIP
+	CODEC_XZ
+	CODEC_LZ4
+	CODEC_S2
+	CODEC_NONE
+)
+
+// The lowest level mapped to SpeedBetterCompression by the encoder, the one used before levels could be configured
+const DEFAULT_ZSTD_LEVEL = 6
+
+var names = map[Codec]string{
+	CODEC_ZSTD: "zstd",
+	CODEC_GZIP: "gzip",
+	CODEC_XZ:   "xz",
+	CODEC_LZ4:  "lz4",
+	CODEC_S2:   "s2",
+	CODEC_NONE: "none",
+}
+
+// Names lists the codecs, in the order they should be shown to the user
+func Names() []string {
+	list := make([]string, 0, len(names))
+	for codec := CODEC_ZSTD; codec <= CODEC_NONE; codec++ {
+		list = append(list, names[codec])
+	}
+	return list
+}
+
+func (c Codec) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Parse returns the codec with the given name. An empty name means the default one (zstd)
+func Parse(name string) (Codec, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return CODEC_ZSTD, nil
+	}
+
+	for codec, n := range names {
+		if n == name {
+			return codec, nil
+		}
+	}
+	return 0, errors.New("unknown compression algorithm: " + name)
+}
+
+// Settings describes how the archive should be compressed. The level only matters when compressing
+type Settings struct {
+	Codec Codec
+	Level int  // 0 means the default level of the codec
+	Store bool // The data is already compressed, so the fastest level (or no compression at all) is used instead
+
+	Concurrency int // Goroutines used by a single encoder or decoder (0 for the default of the codec). Set to 1 when frames are already processed in parallel
+
+	TrainDictionary bool   // Train a zstd dictionary from a sample of the files before compressing them
+	Dictionary      []byte // Trained zstd dictionary, needed for decompression too (empty if not used)
+}
+
+// levels are the highest level of each codec, the lowest being 1. The codecs missing have no levels
+var levels = map[Codec]int{
+	CODEC_ZSTD: 22,
+	CODEC_GZIP: 9,
+	CODEC_LZ4:  9,
+	CODEC_S2:   3,
+}
+
+// Validate checks that the level exists for the codec, and that a dictionary is only used with zstd
+func (s Settings) Validate() error {
+	if _, ok := names[s.Codec]; !ok {
+		return errors.New("unknown compression algorithm")
+	}
+	if highest, ok := levels[s.Codec]; !ok && s.Level != 0 {
+		return fmt.Errorf("%s has no compression levels, remove the level %d", s.Codec, s.Level)
+	} else if ok && (s.Level < 0 || s.Level > highest) {
+		return fmt.Errorf("invalid %s compression level %d, it must be between 1 and %d (0 for the default one)", s.Codec, s.Level, highest)
+	}
+	if (s.TrainDictionary || len(s.Dictionary) > 0) && s.Codec != CODEC_ZSTD {
+		return fmt.Errorf("dictionaries are only supported by zstd, not %s", s.Codec)
+	}
+	return nil
+}
+
+// Stored returns the settings for data that is already compressed
+func (s Settings) Stored() Settings {
+	s.Store = true
+	return s
+}
+
+// Encoder compresses a single frame/stream, and can be reused for the next one after being closed
+type Encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// NewEncoder returns an encoder writing to out.
+// Levels follow the ones of each algorithm: zstd 1-22, gzip 1-9, lz4 1-9, s2 1-3 (xz has none)
+func NewEncoder(out io.Writer, s Settings) (Encoder, error) {
+	switch s.Codec {
+
+	case CODEC_ZSTD:
+		level := s.Level
+		if level == 0 {
+			level = DEFAULT_ZSTD_LEVEL
+		}
+		if s.Store {
+			level = 1 // Incompressible blocks are stored raw anyway
+		}
+
+		concurrency := s.Concurrency
+		if concurrency == 0 {
+			concurrency = 4 // Apprently we can keep concurrency here
+		}
+
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(concurrency)}
+		if len(s.Dictionary) > 0 {
+			opts = append(opts, zstd.WithEncoderDict(s.Dictionary))
+		}
+		return zstd.NewWriter(out, opts...)
+
+	case CODEC_GZIP:
+		level := s.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if s.Store {
+			level = gzip.NoCompression
+		}
+		return gzip.NewWriterLevel(out, level)
+
+	case CODEC_XZ:
+		return newXzEncoder(out) // No levels, not even for data that is already compressed
+
+	case CODEC_LZ4:
+		w := lz4.NewWriter(out)
+		level := lz4.Fast
+		if s.Level > 0 && !s.Store {
+			level = lz4.CompressionLevel(1 << (8 + s.Level))
+		}
+		if err := w.Apply(lz4.CompressionLevelOption(level)); err != nil {
+			return nil, err
+		}
+		return w, nil
+
+	case CODEC_S2:
+		opts := []s2.WriterOption{}
+		if s.Concurrency > 0 {
+			opts = append(opts, s2.WriterConcurrency(s.Concurrency))
+		}
+		if s.Store {
+			opts = append(opts, s2.WriterUncompressed())
+		} else if s.Level == 2 {
+			opts = append(opts, s2.WriterBetterCompression())
+		} else if s.Level >= 3 {
+			opts = append(opts, s2.WriterBestCompression())
+		}
+		return s2.NewWriter(out, opts...), nil
+
+	case CODEC_NONE:
+		return &nopEncoder{out}, nil
+	}
+	return nil, errors.New("unknown compression algorithm")
+}
+
+// NewDecoder returns a reader decompressing in. Multiple frames/streams one after the other are read as one
+func NewDecoder(in io.Reader, s Settings) (io.ReadCloser, error) {
+	switch s.Codec {
+
+	case CODEC_ZSTD:
+		opts := []zstd.DOption{} // No need to specify compression level
+		if s.Concurrency > 0 {
+			opts = append(opts, zstd.WithDecoderConcurrency(s.Concurrency))
+		}
+		if len(s.Dictionary) > 0 {
+			opts = append(opts, zstd.WithDecoderDicts(s.Dictionary))
+		}
+		decoder, err := zstd.NewReader(in, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+
+	case CODEC_GZIP:
+		return gzip.NewReader(in) // Multistream by default
+
+	case CODEC_XZ:
+		decoder, err := xz.NewReader(in) // Multiple streams by default
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(decoder), nil
+
+	case CODEC_LZ4:
+		return io.NopCloser(lz4.NewReader(in)), nil
+
+	case CODEC_S2:
+		return io.NopCloser(s2.NewReader(in)), nil
+
+	case CODEC_NONE:
+		return io.NopCloser(in), nil
+	}
+	return nil, errors.New("unknown compression algorithm")
+}
+
+// * Encoders without a Reset
+
+type xzEncoder struct {
+	*xz.Writer
+}
+
+func newXzEncoder(out io.Writer) (*xzEncoder, error) {
+	w, err := xz.NewWriter(out)
+	if err != nil {
+		return nil, err
+	}
+	return &xzEncoder{w}, nil
+}
+
+func (e *xzEncoder) Reset(out io.Writer) {
+	e.Writer, _ = xz.NewWriter(out) // Only fails with an invalid config, which is always the default one
+}
+
+type nopEncoder struct {
+	io.Writer
+}
+
+func (e *nopEncoder) Close() error {
+	return nil
+}
+
+func (e *nopEncoder) Reset(out io.Writer) {
+	e.Writer = out
+}
@@ -0,0 +1,123 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		settings Settings
+		valid    bool
+	}{
+		{Settings{Codec: CODEC_ZSTD}, true},
+		{Settings{Codec: CODEC_ZSTD, Level: 1}, true},
+		{Settings{Codec: CODEC_ZSTD, Level: 22}, true},
+		{Settings{Codec: CODEC_ZSTD, Level: 23}, false},
+		{Settings{Codec: CODEC_ZSTD, Level: -1}, false},
+		{Settings{Codec: CODEC_GZIP, Level: 9}, true},
+		{Settings{Codec: CODEC_GZIP, Level: 10}, false},
+		{Settings{Codec: CODEC_LZ4, Level: 9}, true},
+		{Settings{Codec: CODEC_LZ4, Level: 12}, false},
+		{Settings{Codec: CODEC_S2, Level: 3}, true},
+		{Settings{Codec: CODEC_S2, Level: 4}, false},
+		{Settings{Codec: CODEC_XZ}, true},
+		{Settings{Codec: CODEC_XZ, Level: 6}, false},
+		{Settings{Codec: CODEC_NONE, Level: 1}, false},
+		{Settings{Codec: CODEC_ZSTD, TrainDictionary: true}, true},
+		{Settings{Codec: CODEC_GZIP, TrainDictionary: true}, false},
+		{Settings{Codec: CODEC_S2, Dictionary: []byte("dict")}, false},
+		{Settings{Codec: CODEC_NONE + 1}, false},
+	}
+	for _, test := range tests {
+		if err := test.settings.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s level %d, dictionary %v: got %v, want valid %v", test.settings.Codec, test.settings.Level, test.settings.TrainDictionary || len(test.settings.Dictionary) > 0, err, test.valid)
+		}
+	}
+}
+
+// testData returns size bytes which compress, but not down to nothing
+func testData(size int) []byte {
+	data := bytes.Buffer{}
+	for i := 0; data.Len() < size; i++ {
+		fmt.Fprintf(&data, "line %d, %x\n", i, i*i)
+	}
+	return data.Bytes()[:size]
+}
+
+func decode(t *testing.T, data []byte, s Settings) []byte {
+	t.Helper()
+	decoder, err := NewDecoder(bytes.NewReader(data), s)
+	if err != nil {
+		t.Fatalf("%s: %v", s.Codec, err)
+	}
+	defer decoder.Close()
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("%s: read: %v", s.Codec, err)
+	}
+	return got
+}
+
+// Every codec, level and stored mode reads back what has been written, with frames one after the other and the encoder reused between them
+func TestRoundTrip(t *testing.T) {
+	frames := [][]byte{testData(1 << 20), {}, testData(1000), []byte("x")}
+	want := bytes.Join(frames, nil)
+
+	for _, name := range Names() {
+		codec, _ := Parse(name)
+		variants := []Settings{{Codec: codec}, {Codec: codec, Store: true}}
+		if highest, ok := levels[codec]; ok {
+			variants = append(variants, Settings{Codec: codec, Level: 1}, Settings{Codec: codec, Level: highest})
+		}
+		if codec == CODEC_ZSTD {
+			samples := [][]byte{}
+			for i := range MIN_DICTIONARY_SAMPLES * 4 {
+				samples = append(samples, testData(500+i*10))
+			}
+			dict, err := TrainDictionary(samples, Settings{Codec: codec})
+			if err != nil {
+				t.Fatalf("train a dictionary: %v", err)
+			}
+			variants = append(variants, Settings{Codec: codec, Dictionary: dict})
+		}
+
+		for _, settings := range variants {
+			compressed := bytes.Buffer{}
+			offsets := []int{0} // Some encoders write their header when created or reset
+			encoder, err := NewEncoder(&compressed, settings)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", name, settings.Level, err)
+			}
+			for i, frame := range frames {
+				if i > 0 {
+					offsets = append(offsets, compressed.Len())
+					encoder.Reset(&compressed)
+				}
+				if _, err := encoder.Write(frame); err != nil {
+					t.Fatalf("%s level %d: write: %v", name, settings.Level, err)
+				}
+				if err := encoder.Close(); err != nil {
+					t.Fatalf("%s level %d: close: %v", name, settings.Level, err)
+				}
+			}
+			if codec != CODEC_NONE && !settings.Store && compressed.Len() >= len(want) {
+				t.Errorf("%s level %d: %d bytes compressed to %d", name, settings.Level, len(want), compressed.Len())
+			}
+
+			// The whole stream, then every frame on its own
+			data := compressed.Bytes()
+			if got := decode(t, data, settings); !bytes.Equal(got, want) {
+				t.Fatalf("%s level %d, stored %v, dictionary %v: %d bytes read back, want %d", name, settings.Level, settings.Store, len(settings.Dictionary) > 0, len(got), len(want))
+			}
+			offsets = append(offsets, len(data))
+			for i, frame := range frames {
+				if got := decode(t, data[offsets[i]:offsets[i+1]], settings); !bytes.Equal(got, frame) {
+					t.Fatalf("%s level %d: frame %d read back as %d bytes, want %d", name, settings.Level, i, len(got), len(frame))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package compression
+
+import (
+	"errors"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const MAX_DICTIONARY_SIZE = 112 << 10 // Same as the default of the zstd cli
+const MIN_DICTIONARY_SAMPLES = 16     // With less files, there isn't much to learn
+
+// DICTIONARY_SAMPLE_SIZE is the size of the largest file used for training. Bigger files compress well enough on their own
+const DICTIONARY_SAMPLE_SIZE = 64 << 10
+const DICTIONARY_SAMPLES = 4096
+
+var ErrFewSamples = errors.New("not enough small files to train a dictionary")
+
+// TrainDictionary builds a zstd dictionary from a sample of the files, tailored for the compression level
+func TrainDictionary(samples [][]byte, s Settings) ([]byte, error) {
+	if s.Codec != CODEC_ZSTD {
+		return nil, errors.New("dictionaries are only supported by zstd")
+	}
+	if len(samples) < MIN_DICTIONARY_SAMPLES {
+		return nil, ErrFewSamples
+	}
+
+	level := s.Level
+	if level == 0 {
+		level = DEFAULT_ZSTD_LEVEL
+	}
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: MAX_DICTIONARY_SIZE,
+		HashBytes:   6,
+		ZstdLevel:   zstd.EncoderLevelFromZstd(level),
+	})
+}
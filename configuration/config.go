@@ -1,17 +1,25 @@
 package configuration
 
 import (
+	"backupusb/archive"
+	"backupusb/backups"
+	"backupusb/compression"
 	"backupusb/crypto"
-	"bufio"
 	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"time"
 )
 
 const CONFIG_PATH = "config.bc"
 const DEFAULT_DESTINATION = "data/"
 
+var ErrNoConfig = errors.New("no config file found")
+var ErrInvalidConfig = errors.New("invalid config file")
+
 func getConfigKey() (key, iv []byte) {
 	// These two are just static values used for static encryption.
 	// They are meant to be left as static values inside the binary and will only add a SMALL layer of security through obscurity.
@@ -21,10 +29,67 @@ func getConfigKey() (key, iv []byte) {
 }
 
 type Config struct {
-	Key         string   // The public key
-	Paths       []string // A list of folders/files to backup
-	Amount      int      // Max amount of backups to store (oldest deleted first, set to -1 to disable)
-	Destination string   // The folder where the backups are stored
+	Key              string   // The public key
+	Paths            []string // A list of folders/files to backup
+	Amount           int      // Max amount of backups to store (oldest deleted first, set to -1 to disable)
+	KeepDaily        int      // Also keep the newest backup of each of the last days (0 to disable)
+	KeepWeekly       int      // Same, for the weeks
+	KeepMonthly      int      // Same, for the months
+	KeepYearly       int      // Same, for the years
+	MaxAge           int      // Days after which backups are removed, even if kept by the rules above (0 for no limit)
+	MaxSize          int      // MB taken by all the backups of a destination (0 for no limit)
+	MinFreeSpace     int      // MB left free in each destination, by removing the oldest backups (0 to disable)
+	PruneEarly       bool     // Without enough space for the new backup, remove the backups the retention would remove afterwards, instead of skipping the destination
+	PruneLegacy      bool     // Also apply the retention to the backups created before the preamble, recognized only by their names
+	Destination      string   // Deprecated: moved to Destinations when loading
+	Destinations     []string // The folders where the backups are stored, either local, sftp://, s3:// or webdav:// urls
+	RequireAll       bool     // Fail the backup if any destination fails, instead of only when all of them do
+	Report           bool     // Store a JSON report next to each backup (<name>.json)
+	Compression      string   // The compression algorithm (zstd if empty)
+	CompressionLevel int      // The compression level, specific to each algorithm (0 for the default one)
+	Incompressible   []string // Extensions of the files that are already compressed, and so only stored (the default ones if empty)
+	Dictionary       bool     // Train a dictionary from the files before compressing them (zstd only, useful for many small files)
+	Workers          int      // Files read and compressed at the same time (the number of cpus if 0)
+	MemoryLimit      int      // MB of compressed files waiting to be written (256 if 0)
+}
+
+func (c *Config) IncompressibleFiles() *archive.Incompressible {
+	if len(c.Incompressible) == 0 {
+		return archive.NewIncompressible(archive.DEFAULT_INCOMPRESSIBLE)
+	}
+	return archive.NewIncompressible(c.Incompressible)
+}
+
+func (c *Config) TarOptions() archive.TarOptions {
+	return archive.TarOptions{
+		Incompressible: c.IncompressibleFiles(),
+		Workers:        c.Workers,
+		MemoryLimit:    int64(c.MemoryLimit) << 20,
+	}
+}
+
+// Retention returns the rules deciding which backups are kept in every destination
+func (c *Config) Retention() backups.Retention {
+	return backups.Retention{
+		Last:    c.Amount,
+		Daily:   c.KeepDaily,
+		Weekly:  c.KeepWeekly,
+		Monthly: c.KeepMonthly,
+		Yearly:  c.KeepYearly,
+		MaxAge:  time.Duration(c.MaxAge) * 24 * time.Hour,
+		MaxSize: int64(c.MaxSize) << 20,
+		MinFree: int64(c.MinFreeSpace) << 20,
+		Legacy:  c.PruneLegacy,
+	}
+}
+
+func (c *Config) CompressionSettings() (compression.Settings, error) {
+	codec, err := compression.Parse(c.Compression)
+	if err != nil {
+		return compression.Settings{}, err
+	}
+	settings := compression.Settings{Codec: codec, Level: c.CompressionLevel, TrainDictionary: c.Dictionary}
+	return settings, settings.Validate()
 }
 
 func (c *Config) Save() error {
@@ -36,81 +101,71 @@ func (c *Config) Save() error {
 
 	// Pass through encryptor
 	key, iv := getConfigKey()
+	defer crypto.DestroyKey(key)
+	defer crypto.DestroyKey(iv)
 	aesWriter, err := crypto.NewAesWriter(key, iv, confFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer aesWriter.Close()
 
 	// Serialize data
 	enc := gob.NewEncoder(aesWriter)
 	if err := enc.Encode(c); err != nil {
-		panic(err)
+		aesWriter.Close()
+		return err
 	}
-
-	crypto.DestroyKey(key)
-	crypto.DestroyKey(iv)
-	return nil
+	return aesWriter.Close()
 }
 
-func createDefault(pubKey string) *Config {
+// CreateDefault generates a new key pair, and saves a default config with the public key.
+// The private key is only returned, so that it can be shown to the user
+func CreateDefault() (config *Config, privKey string, err error) {
+	privKey, pubKey, err := crypto.GenParsedKeyPair()
+	if err != nil {
+		return nil, "", err
+	}
 
 	// Generate default config
-	config := Config{
-		Key:         pubKey,
-		Amount:      5,
-		Paths:       []string{},
-		Destination: DEFAULT_DESTINATION,
+	config = &Config{
+		Key:          pubKey,
+		Amount:       5,
+		Paths:        []string{},
+		Destinations: []string{DEFAULT_DESTINATION},
+		Compression:  compression.CODEC_ZSTD.String(),
 	}
-
-	config.Save()
-	return &config
+	return config, privKey, config.Save()
 }
 
+// Load reads the config file, returning ErrNoConfig if there's none yet
 func Load() (*Config, error) {
 	confFile, err := os.Open(CONFIG_PATH)
-
-	// No config file found
-	if err != nil {
-		if !os.IsNotExist(err) {
-			panic(err)
-		}
-
-		// Generate default config
-		privKey, pubKey := crypto.GenParsedKeyPair()
-		config := createDefault(pubKey)
-		fmt.Printf(
-			"No config file found, so a default one has been created\nThis is a brand new randly generated private/decryption key: \n\n%s\n\n"+
-				"The public key has already been added to the config file. Please take note of the private key, and store it in a safe place\n"+
-				"To edit the config in the future, you can simply run: %s config\n\n"+
-				" - Press ENTER to continue editing the configuration...", privKey, os.Args[0],
-		)
-		bufio.NewReader(os.Stdin).ReadBytes('\n') // Pause console
-
-		config.OpenEditor()
-		fmt.Println(
-			"All done. Next time you run the program, it will start backing up with the new configuration., ",
-			"\nYou can also edit the config again by using:", os.Args[0], "config",
-		)
-		os.Exit(0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoConfig
+	} else if err != nil {
+		return nil, err
 	}
 	defer confFile.Close()
 
 	// Pass through decryptor
 	key, iv := getConfigKey()
+	defer crypto.DestroyKey(key)
+	defer crypto.DestroyKey(iv)
 	aesReader, err := crypto.NewAesReader(key, iv, confFile)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Deserialize data
 	var config Config
 	dec := gob.NewDecoder(aesReader)
 	if err := dec.Decode(&config); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
 	}
 
-	crypto.DestroyKey(key)
-	crypto.DestroyKey(iv)
+	// Configs from older versions only had a single destination
+	if len(config.Destinations) == 0 && config.Destination != "" {
+		config.Destinations = []string{config.Destination}
+	}
+	config.Destination = ""
 	return &config, nil
 }
@@ -1,6 +1,8 @@
 package configuration
 
 import (
+	"backupusb/archive"
+	"backupusb/compression"
 	"fmt"
 	"strconv"
 	"strings"
@@ -89,15 +91,149 @@ func (c *Config) OpenEditor() {
 	})
 	form.AddFormItem(amountField)
 
-	// Destination:
-	destinationField := tview.NewInputField().
-		SetLabel("Destination:").
+	// Keep Daily:
+	keepDailyField := tview.NewInputField().
+		SetLabel("Keep daily (0 = disabled):").
 		SetFieldWidth(fieldWidth).
-		SetText("\"" + c.Destination + "\"")
-	destinationField.SetBlurFunc(func() { // Format string when unfocused
-		destinationField.SetText("\"" + strings.Trim(clearPath(destinationField.GetText()), " ") + "\"")
+		SetText(strconv.Itoa(c.KeepDaily)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(keepDailyField)
+
+	// Keep Weekly:
+	keepWeeklyField := tview.NewInputField().
+		SetLabel("Keep weekly (0 = disabled):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.KeepWeekly)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(keepWeeklyField)
+
+	// Keep Monthly:
+	keepMonthlyField := tview.NewInputField().
+		SetLabel("Keep monthly (0 = disabled):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.KeepMonthly)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(keepMonthlyField)
+
+	// Keep Yearly:
+	keepYearlyField := tview.NewInputField().
+		SetLabel("Keep yearly (0 = disabled):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.KeepYearly)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(keepYearlyField)
+
+	// Max Age:
+	maxAgeField := tview.NewInputField().
+		SetLabel("Max age in days (0 = no limit):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.MaxAge)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(maxAgeField)
+
+	// Max Size:
+	maxSizeField := tview.NewInputField().
+		SetLabel("Max size in MB (0 = no limit):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.MaxSize)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(maxSizeField)
+
+	// Min Free Space:
+	minFreeField := tview.NewInputField().
+		SetLabel("Min free space in MB (0 = disabled):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.MinFreeSpace)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(minFreeField)
+
+	// Prune Early:
+	pruneEarlyField := tview.NewCheckbox().
+		SetLabel("Prune early if there isn't enough space:").
+		SetChecked(c.PruneEarly)
+	form.AddFormItem(pruneEarlyField)
+
+	// Prune Legacy:
+	pruneLegacyField := tview.NewCheckbox().
+		SetLabel("Apply the retention to old backups:").
+		SetChecked(c.PruneLegacy)
+	form.AddFormItem(pruneLegacyField)
+
+	// Destinations (comma separated):
+	destinationsField := tview.NewInputField().
+		SetLabel("Destinations (comma separated):").
+		SetFieldWidth(fieldWidth).
+		SetText("\"" + strings.Join(c.Destinations, "\", \"") + "\"")
+	destinationsField.SetBlurFunc(func() { // Format string when unfocused
+		destinationsField.SetText("\"" + strings.Join(splitPaths(destinationsField.GetText()), "\", \"") + "\"")
+	})
+	form.AddFormItem(destinationsField)
+
+	// Require All:
+	requireAllField := tview.NewCheckbox().
+		SetLabel("Fail if any destination fails:").
+		SetChecked(c.RequireAll)
+	form.AddFormItem(requireAllField)
+
+	// Report:
+	reportField := tview.NewCheckbox().
+		SetLabel("Store a JSON report next to each backup:").
+		SetChecked(c.Report)
+	form.AddFormItem(reportField)
+
+	// Compression:
+	codecs := compression.Names()
+	settings, _ := c.CompressionSettings() // An unknown codec falls back to the default
+	compressionField := tview.NewDropDown().
+		SetLabel("Compression:").
+		SetFieldWidth(fieldWidth).
+		SetOptions(codecs, nil).
+		SetCurrentOption(int(settings.Codec))
+	form.AddFormItem(compressionField)
+
+	// Compression Level:
+	levelField := tview.NewInputField().
+		SetLabel("Compression Level (0 = default):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.CompressionLevel)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(levelField)
+
+	// Dictionary:
+	dictionaryField := tview.NewCheckbox().
+		SetLabel("Train dictionary (zstd, many small files):").
+		SetChecked(c.Dictionary)
+	form.AddFormItem(dictionaryField)
+
+	// Already compressed (comma separated):
+	incompressible := c.Incompressible
+	if len(incompressible) == 0 {
+		incompressible = archive.DEFAULT_INCOMPRESSIBLE
+	}
+	incompressibleField := tview.NewInputField().
+		SetLabel("Already compressed extensions:").
+		SetFieldWidth(fieldWidth).
+		SetText(strings.Join(incompressible, ", "))
+	incompressibleField.SetBlurFunc(func() { // Format string when unfocused
+		incompressibleField.SetText(strings.Join(splitPaths(incompressibleField.GetText()), ", "))
 	})
-	form.AddFormItem(destinationField)
+	form.AddFormItem(incompressibleField)
+
+	// Workers:
+	workersField := tview.NewInputField().
+		SetLabel("Workers (0 = number of cpus):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.Workers)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(workersField)
+
+	// Memory Limit:
+	memoryField := tview.NewInputField().
+		SetLabel("Memory Limit in MB (0 = 256):").
+		SetFieldWidth(fieldWidth).
+		SetText(strconv.Itoa(c.MemoryLimit)).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	form.AddFormItem(memoryField)
 
 	// * BUTTONS
 
@@ -120,7 +256,43 @@ func (c *Config) OpenEditor() {
 		}
 		c.Amount = max(n, 1) // At least one
 
-		c.Destination = clearPath(destinationField.GetText())
+		c.KeepDaily, _ = strconv.Atoi(keepDailyField.GetText())
+		c.KeepDaily = max(c.KeepDaily, 0)
+		c.KeepWeekly, _ = strconv.Atoi(keepWeeklyField.GetText())
+		c.KeepWeekly = max(c.KeepWeekly, 0)
+		c.KeepMonthly, _ = strconv.Atoi(keepMonthlyField.GetText())
+		c.KeepMonthly = max(c.KeepMonthly, 0)
+		c.KeepYearly, _ = strconv.Atoi(keepYearlyField.GetText())
+		c.KeepYearly = max(c.KeepYearly, 0)
+		c.MaxAge, _ = strconv.Atoi(maxAgeField.GetText())
+		c.MaxAge = max(c.MaxAge, 0)
+		c.MaxSize, _ = strconv.Atoi(maxSizeField.GetText())
+		c.MaxSize = max(c.MaxSize, 0)
+		c.MinFreeSpace, _ = strconv.Atoi(minFreeField.GetText())
+		c.MinFreeSpace = max(c.MinFreeSpace, 0)
+		c.PruneEarly = pruneEarlyField.IsChecked()
+		c.PruneLegacy = pruneLegacyField.IsChecked()
+
+		c.Destinations = splitPaths(destinationsField.GetText())
+		if len(c.Destinations) == 0 {
+			c.Destinations = []string{DEFAULT_DESTINATION}
+		}
+		c.RequireAll = requireAllField.IsChecked()
+		c.Report = reportField.IsChecked()
+
+		_, c.Compression = compressionField.GetCurrentOption()
+		c.CompressionLevel, _ = strconv.Atoi(levelField.GetText())
+		c.CompressionLevel = max(c.CompressionLevel, 0)
+		c.Dictionary = dictionaryField.IsChecked()
+		if _, err := c.CompressionSettings(); err != nil {
+			fmt.Printf("Invalid compression: %v\n", err)
+			return
+		}
+		c.Incompressible = splitPaths(incompressibleField.GetText())
+		c.Workers, _ = strconv.Atoi(workersField.GetText())
+		c.Workers = max(c.Workers, 0)
+		c.MemoryLimit, _ = strconv.Atoi(memoryField.GetText())
+		c.MemoryLimit = max(c.MemoryLimit, 0)
 
 		c.Save()
 		app.Stop()
@@ -36,3 +36,31 @@ func NewAesReader(aesKey, iv []byte, in io.Reader) (io.Reader, error) {
 
 	return &cipher.StreamReader{S: stream, R: in}, nil
 }
+
+// NewAesReaderAt decrypts a stream starting from the given offset of the encrypted data, instead of from its start
+func NewAesReaderAt(aesKey, iv []byte, offset int64, in io.Reader) (io.Reader, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV length")
+	}
+
+	// CTR increments the whole IV as a big endian counter, once per block
+	shiftedIV := make([]byte, aes.BlockSize)
+	copy(shiftedIV, iv)
+	carry := uint64(offset / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(shiftedIV[i]) + carry&0xff
+		shiftedIV[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream, err := getStream(aesKey, shiftedIV)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the part of the block before the offset
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+
+	return &cipher.StreamReader{S: stream, R: in}, nil
+}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// Decrypting from any offset gives the same bytes as decrypting from the start, even when the counter carries into the other bytes of the IV
+func TestAesReaderAt(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	plain := make([]byte, 5000)
+	rand.Read(plain)
+
+	randomIV := make([]byte, 16)
+	rand.Read(randomIV)
+	carryIV := bytes.Repeat([]byte{0xff}, 16) // Every block carries over the whole IV, and then wraps around
+	almostIV := append(make([]byte, 8), 0, 0, 0, 0, 0, 0, 0xff, 0xf0)
+
+	for _, iv := range [][]byte{randomIV, carryIV, almostIV, make([]byte, 16)} {
+		encrypted := bytes.Buffer{}
+		w, err := NewAesWriter(key, iv, &encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain)
+
+		for _, offset := range []int64{0, 1, 15, 16, 17, 255, 256, 4095, 4096, 4097, 4999, 5000} {
+			r, err := NewAesReaderAt(key, iv, offset, bytes.NewReader(encrypted.Bytes()[offset:]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain[offset:]) {
+				t.Fatalf("iv %x: decrypting from %d doesn't match", iv, offset)
+			}
+		}
+	}
+
+	if _, err := NewAesReaderAt(key, make([]byte, 8), 0, nil); err == nil {
+		t.Fatal("an invalid IV has been accepted")
+	}
+}
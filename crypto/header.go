@@ -4,10 +4,18 @@ import (
 	"errors"
 	"hash"
 	"io"
+
+	"lukechampine.com/blake3"
 )
 
 const IV_SIZE = 16 // MUST BE < CIPHER_SIZE | The secret is 32B, but we only take the first 16B
 const ENCRYPTED_HEADER_SIZE = CIPHER_SIZE * 3
+const KEY_CHECK_SIZE = 32
+
+const keyCheckContext = "BackupUSB key check" // Keeps the key check distinct from the other macs
+
+// Decrypting with another private key doesn't fail, it just returns different keys. Only the key check can tell
+var ErrWrongKey = errors.New("the private key isn't the one the file has been encrypted for")
 
 type EncryptedHeader Header
 type Header struct {
@@ -32,21 +40,38 @@ func ParseHeader(in []byte) (*EncryptedHeader, error) {
 	return &header, nil
 }
 
-func (h *EncryptedHeader) DecryptKeys(privateKey []byte) *Header {
-	return &Header{
-		AesKey: ParseDecrypt(h.AesKey, privateKey),
-		IV:     ParseDecrypt(h.IV, privateKey)[:IV_SIZE],
-		MacKey: ParseDecrypt(h.MacKey, privateKey),
+func (h *EncryptedHeader) DecryptKeys(privateKey []byte) (*Header, error) {
+	aesKey, err := ParseDecrypt(h.AesKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := ParseDecrypt(h.IV, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := ParseDecrypt(h.MacKey, privateKey)
+	if err != nil {
+		return nil, err
 	}
+	return &Header{AesKey: aesKey, IV: iv[:IV_SIZE], MacKey: macKey}, nil
 }
 
 // * Encrypt
 
-func GenHeader(pubKey [PUB_KEY_SIZE]byte) (*Header, *EncryptedHeader) {
+func GenHeader(pubKey [PUB_KEY_SIZE]byte) (*Header, *EncryptedHeader, error) {
 	// en_ indica i valori cryptati
-	enAesKey, aesKey := GetSharedKey(pubKey)
-	enMacKey, macKey := GetSharedKey(pubKey)
-	enIV, shIV := GetSharedKey(pubKey) // We have a shared value, as kyber only allowes for 32 bytes secrets, but we use 16 bytes IVs
+	enAesKey, aesKey, err := GetSharedKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	enMacKey, macKey, err := GetSharedKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	enIV, shIV, err := GetSharedKey(pubKey) // We have a shared value, as kyber only allowes for 32 bytes secrets, but we use 16 bytes IVs
+	if err != nil {
+		return nil, nil, err
+	}
 
 	header := &Header{
 		AesKey: aesKey[:],
@@ -60,7 +85,7 @@ func GenHeader(pubKey [PUB_KEY_SIZE]byte) (*Header, *EncryptedHeader) {
 		IV:     enIV[:],
 	}
 
-	return header, enHeader
+	return header, enHeader, nil
 }
 
 func (h *EncryptedHeader) Dump() []byte {
@@ -72,16 +97,32 @@ func (h *EncryptedHeader) Dump() []byte {
 	return b
 }
 
+// KeyCheck is derived from the mac key, and stored with the encrypted header to tell whether it has been decrypted with the right private key
+func (h *Header) KeyCheck() []byte {
+	mac := blake3.New(KEY_CHECK_SIZE, h.MacKey)
+	mac.Write([]byte(keyCheckContext))
+	return mac.Sum(nil)
+}
+
+// VerifyKeyCheck returns ErrWrongKey if the header hasn't been decrypted with the private key it has been encrypted for
+func (h *Header) VerifyKeyCheck(check []byte) error {
+	if !CompareMacSums(h.KeyCheck(), check) {
+		return ErrWrongKey
+	}
+	return nil
+}
+
 func (h *Header) Destroy() {
 	DestroyKey(h.AesKey)
 	DestroyKey(h.IV)
 	DestroyKey(h.MacKey)
 }
 
-func ReadHeader(in io.Reader, privKey []byte) (*Header, hash.Hash, error) {
+// ReadHeader reads and decrypts the header, returning a mac of the preamble (the plain data before the macsum, if any) and the encrypted header
+func ReadHeader(in io.Reader, privKey []byte, preamble []byte) (*Header, hash.Hash, error) {
 	// Read encrypted header
 	data := make([]byte, ENCRYPTED_HEADER_SIZE)
-	if _, err := in.Read(data); err != nil {
+	if _, err := io.ReadFull(in, data); err != nil {
 		return nil, nil, err
 	}
 
@@ -90,8 +131,12 @@ func ReadHeader(in io.Reader, privKey []byte) (*Header, hash.Hash, error) {
 		return nil, nil, err
 	}
 
-	header := enHeader.DecryptKeys(privKey)
+	header, err := enHeader.DecryptKeys(privKey)
+	if err != nil {
+		return nil, nil, err
+	}
 	mac := NewMAC(header.MacKey)
+	mac.Write(preamble)
 	mac.Write(data)
 
 	return header, mac, nil
@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"encoding/base64"
+	"errors"
 
 	kyberk2so "github.com/symbolicsoft/kyber-k2so"
 )
@@ -11,36 +12,32 @@ const PRIV_KEY_SIZE = kyberk2so.Kyber1024SKBytes
 const SECRET_SIZE = kyberk2so.KyberSSBytes
 const CIPHER_SIZE = PUB_KEY_SIZE
 
-func GenKeyPair() (privKey [PRIV_KEY_SIZE]byte, pubKey [PUB_KEY_SIZE]byte) {
-	privKey, pubKey, err := kyberk2so.KemKeypair1024()
-	if err != nil {
-		panic(err)
-	}
-	return privKey, pubKey
-}
+var ErrInvalidKey = errors.New("invalid key")
 
-func GenParsedKeyPair() (privKey string, pubKey string) {
-	sK, pK := GenKeyPair()
-	return base64.RawStdEncoding.EncodeToString(sK[:]), base64.RawStdEncoding.EncodeToString(pK[:])
+func GenKeyPair() (privKey [PRIV_KEY_SIZE]byte, pubKey [PUB_KEY_SIZE]byte, err error) {
+	return kyberk2so.KemKeypair1024()
 }
 
-func GetSharedKey(pubKey [PUB_KEY_SIZE]byte) (chiper [CIPHER_SIZE]byte, secret [SECRET_SIZE]byte) {
-	chiper, secret, err := kyberk2so.KemEncrypt1024(pubKey)
+func GenParsedKeyPair() (privKey string, pubKey string, err error) {
+	sK, pK, err := GenKeyPair()
 	if err != nil {
-		panic(err)
+		return "", "", err
 	}
-	return chiper, secret
+	return base64.RawStdEncoding.EncodeToString(sK[:]), base64.RawStdEncoding.EncodeToString(pK[:]), nil
 }
 
-func DecryptKey(cipher [CIPHER_SIZE]byte, privKey [PRIV_KEY_SIZE]byte) (secret [SECRET_SIZE]byte) {
-	secret, err := kyberk2so.KemDecrypt1024(cipher, privKey)
-	if err != nil {
-		panic(err)
-	}
-	return secret
+func GetSharedKey(pubKey [PUB_KEY_SIZE]byte) (chiper [CIPHER_SIZE]byte, secret [SECRET_SIZE]byte, err error) {
+	return kyberk2so.KemEncrypt1024(pubKey)
+}
+
+func DecryptKey(cipher [CIPHER_SIZE]byte, privKey [PRIV_KEY_SIZE]byte) (secret [SECRET_SIZE]byte, err error) {
+	return kyberk2so.KemDecrypt1024(cipher, privKey)
 }
 
-func ParseDecrypt(cipher, privKey []byte) []byte {
-	r := DecryptKey([CIPHER_SIZE]byte(cipher), [PRIV_KEY_SIZE]byte(privKey))
-	return r[:]
+func ParseDecrypt(cipher, privKey []byte) ([]byte, error) {
+	if len(cipher) != CIPHER_SIZE || len(privKey) != PRIV_KEY_SIZE {
+		return nil, ErrInvalidKey
+	}
+	r, err := DecryptKey([CIPHER_SIZE]byte(cipher), [PRIV_KEY_SIZE]byte(privKey))
+	return r[:], err
 }
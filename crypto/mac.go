@@ -2,17 +2,34 @@ package crypto
 
 import (
 	"crypto/hmac"
+	"errors"
 	"hash"
 
 	"lukechampine.com/blake3"
 )
 
 const MACSUM_SIZE = 64 // Encrypted with AES, so EncryptedSize = Size
+const CHECKSUM_SIZE = 32
+
+var ErrMACMismatch = errors.New("invalid macsum")
 
 func NewMAC(key []byte) hash.Hash {
 	return blake3.New(64, key)
 }
 
+// NewChecksum is an unkeyed hash, which only detects corruption, but can be verified without any key
+func NewChecksum() hash.Hash {
+	return blake3.New(CHECKSUM_SIZE, nil)
+}
+
 func CompareMacSums(macSum1, macSum2 []byte) bool {
 	return hmac.Equal(macSum1, macSum2) // Unnecessary, but let's leave it as is for good practice
 }
+
+// VerifyMacSum returns ErrMACMismatch if the macsums are different
+func VerifyMacSum(expected, actual []byte) error {
+	if !CompareMacSums(expected, actual) {
+		return ErrMACMismatch
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isDiskFull tells if the error comes from a full disk
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
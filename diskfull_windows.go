@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isDiskFull tells if the error comes from a full disk, which Windows reports with its own codes instead of ENOSPC
+func isDiskFull(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
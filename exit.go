@@ -0,0 +1,100 @@
+package main
+
+import (
+	"backupusb/archive"
+	"backupusb/backups"
+	"backupusb/configuration"
+	"backupusb/crypto"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Exit statuses, documented in the README
+const (
+	EXIT_FAILURE        = 1   // Any other error, including invalid arguments
+	EXIT_CONFIG         = 2   // The config is corrupted or invalid
+	EXIT_WRONG_KEY      = 3   // The private key is invalid, or isn't the one the backup has been encrypted for
+	EXIT_TAMPERED       = 4   // The backup has been modified since it was created
+	EXIT_CORRUPTED      = 5   // The checksum of the backup doesn't match
+	EXIT_SOURCE_MISSING = 6   // A path to back up doesn't exist
+	EXIT_NO_SPACE       = 7   // A destination, or the folder being restored to, is full
+	EXIT_DESTINATION    = 8   // The backup couldn't be stored in enough destinations
+	EXIT_INTERRUPTED    = 130 // Ctrl-C or SIGTERM, the same status used by the shells for SIGINT
+)
+
+// exitStatus returns the exit status for the error, from the most specific cause
+func exitStatus(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return EXIT_INTERRUPTED
+	case errors.Is(err, crypto.ErrWrongKey), errors.Is(err, crypto.ErrInvalidKey):
+		return EXIT_WRONG_KEY
+	case errors.Is(err, crypto.ErrMACMismatch), errors.Is(err, backups.ErrTampered), errors.Is(err, archive.ErrContentMismatch):
+		return EXIT_TAMPERED
+	case errors.Is(err, backups.ErrCorrupted):
+		return EXIT_CORRUPTED
+	case errors.Is(err, archive.ErrSourceMissing):
+		return EXIT_SOURCE_MISSING
+	case isDiskFull(err), errors.Is(err, backups.ErrNotEnoughSpace):
+		return EXIT_NO_SPACE
+	case errors.Is(err, configuration.ErrInvalidConfig):
+		return EXIT_CONFIG
+	case errors.Is(err, backups.ErrBackupFailed), errors.Is(err, backups.ErrNoDestination):
+		return EXIT_DESTINATION
+	}
+	return EXIT_FAILURE
+}
+
+// errorHint tells what can be done about the error, if it's a known one
+func errorHint(err error) string {
+	switch exitStatus(err) {
+	case EXIT_WRONG_KEY:
+		return "Make sure that you are using the private key shown when the config has been created"
+	case EXIT_TAMPERED:
+		if errors.Is(err, crypto.ErrMACMismatch) {
+			return "Don't trust the content of this backup. For backups created by older versions, a wrong private key looks the same"
+		}
+		return "Don't trust the content of this backup"
+	case EXIT_CORRUPTED:
+		return "The backup has been damaged (ex. by a failing drive). Use a copy from another destination, if there's one"
+	case EXIT_SOURCE_MISSING:
+		return "Check the paths to back up with: " + os.Args[0] + " config"
+	case EXIT_NO_SPACE:
+		if isDiskFull(err) { // Otherwise the error already tells how much space is needed
+			return "Free some space, and run the same command again"
+		}
+	}
+	if errors.Is(err, backups.ErrNewerVersion) {
+		return "Update the program to read it"
+	}
+	return ""
+}
+
+// exitWith prints the error and what can be done about it, and the report with --output json, before exiting with the status of the error
+func exitWith(report *backups.Report, message string, err error) {
+	fmt.Println(message, err)
+	if hint := errorHint(err); hint != "" {
+		fmt.Println(hint)
+	}
+	if report != nil {
+		if len(report.Errors) == 0 {
+			report.Fail(err)
+		}
+		printReport(report)
+	}
+	os.Exit(exitStatus(err))
+}
+
+// exitInterrupted tells what has been left behind by the interruption, and prints the report with --output json, before exiting
+func exitInterrupted(report *backups.Report, message string) {
+	fmt.Println("\nInterrupted.", message)
+	if report != nil {
+		if len(report.Errors) == 0 {
+			report.Fail(context.Canceled)
+		}
+		printReport(report)
+	}
+	os.Exit(EXIT_INTERRUPTED)
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"backupusb/archive"
 	"backupusb/backups"
 	"backupusb/configuration"
 	"backupusb/crypto"
+	"backupusb/storage"
+	"bufio"
+	"context"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/f1bonacc1/glippy"
 )
 
 var usageMsgs = map[string]string{
-	"help":    "help",
-	"config":  "config",
-	"decrypt": "decrypt <file> [destination] [--tar]",
+	"help":   "help",
+	"backup": "[--quiet | --verbose] [--output json]",
+	"config": "config",
+	"decrypt": "decrypt <file> [destination | --in-place] [--tar] [--include <pattern>]... [--exclude <pattern>]...\n" +
+		"            [--overwrite | --skip-existing | --overwrite-if-newer | --rename] [--dry-run] [--quiet | --verbose] [--output json]",
+	"list":      "list <file> [--json | --output json] [--include <pattern>]... [--exclude <pattern>]...",
+	"diff":      "diff <file> [other file] [--json] [--include <pattern>]... [--exclude <pattern>]...",
+	"verify":    "verify <file> [--quiet] [--output json]",
+	"replicate": "replicate <from> <to> [--keep <amount>]",
+	"prune":     "prune [destination] [--dry-run]",
+	"estimate":  "estimate",
 }
 
 const invalidConfigMsg = "Invalid config file. Please delete it and generate a new one"
@@ -31,18 +49,183 @@ func parsePath(path string) string {
 	return strings.ReplaceAll(path, "\\", "/")
 }
 
+// parseFilter removes the --include and --exclude flags from the arguments
+func parseFilter(args []string, usageMsg string) ([]string, *archive.Filter) {
+	args, include, err := popValues(args, "--include")
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println(usageMsg)
+		os.Exit(1)
+	}
+	args, exclude, err := popValues(args, "--exclude")
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println(usageMsg)
+		os.Exit(1)
+	}
+
+	filter, err := archive.NewFilter(include, exclude)
+	if err != nil {
+		fmt.Println("Invalid pattern:", err)
+		os.Exit(1)
+	}
+	return args, filter
+}
+
+// parseConflict removes the restore policy flags from the arguments
+func parseConflict(args []string, inPlace bool) ([]string, archive.Conflict) {
+	policies := []struct {
+		flag     string
+		conflict archive.Conflict
+	}{
+		{"--overwrite", archive.CONFLICT_OVERWRITE},
+		{"--skip-existing", archive.CONFLICT_SKIP},
+		{"--overwrite-if-newer", archive.CONFLICT_OVERWRITE_IF_NEWER},
+		{"--rename", archive.CONFLICT_RENAME},
+	}
+
+	// Restoring in place should never replace anything by default
+	conflict := archive.CONFLICT_OVERWRITE
+	if inPlace {
+		conflict = archive.CONFLICT_SKIP
+	}
+
+	found := 0
+	for _, policy := range policies {
+		var ok bool
+		if args, ok = popFlag(args, policy.flag); ok {
+			conflict = policy.conflict
+			found++
+		}
+	}
+	if found > 1 {
+		fmt.Println("Only one of --overwrite, --skip-existing, --overwrite-if-newer and --rename can be used")
+		os.Exit(1)
+	}
+	return args, conflict
+}
+
+// readPrivKey gets the private key either from the env variable or from the clipboard.
+// Messages are printed to stderr, to keep stdout clean for the commands that output data
+func readPrivKey() ([]byte, bool) {
+	b64PrivKey := strings.Trim(os.Getenv("PRIV_KEY"), " ") // Checks if stored
+	if b64PrivKey == "" {
+		fmt.Fprintln(os.Stderr, "Copy the private key to the clipboard and press Enter...")
+		fmt.Scanln() // Wait for user to confirm they copied it
+
+		content, err := glippy.Get()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Clipboard access not supported")
+			fmt.Fprintln(os.Stderr, "Please use the env variabile instead (PRIV_KEY)")
+			return nil, false
+		}
+		b64PrivKey = content
+	}
+
+	// Verifies it
+	privKey, err := base64.RawStdEncoding.DecodeString(b64PrivKey)
+	if err != nil || len(privKey) != crypto.PRIV_KEY_SIZE {
+		fmt.Fprintln(os.Stderr, "Invalid key")
+		os.Exit(EXIT_WRONG_KEY)
+	}
+	crypto.DestroyKeyString(&b64PrivKey) // Works poorly but it's not really required, so we'll leave it here
+	return privKey, true
+}
+
+// loadConfig loads the config, creating a default one on the first run. The program exits if it can't be loaded
+func loadConfig() *configuration.Config {
+	config, err := configuration.Load()
+	if err == nil {
+		return config
+	}
+	if !errors.Is(err, configuration.ErrNoConfig) {
+		fmt.Println(invalidConfigMsg)
+		os.Exit(EXIT_CONFIG)
+	}
+
+	// Generate default config
+	config, privKey, err := configuration.CreateDefault()
+	if err != nil {
+		fmt.Println("Unable to create the config file:", err)
+		os.Exit(1)
+	}
+	fmt.Printf(
+		"No config file found, so a default one has been created\nThis is a brand new randly generated private/decryption key: \n\n%s\n\n"+
+			"The public key has already been added to the config file. Please take note of the private key, and store it in a safe place\n"+
+			"To edit the config in the future, you can simply run: %s config\n\n"+
+			" - Press ENTER to continue editing the configuration...", privKey, os.Args[0],
+	)
+	bufio.NewReader(os.Stdin).ReadBytes('\n') // Pause console
+
+	config.OpenEditor()
+	fmt.Println(
+		"All done. Next time you run the program, it will start backing up with the new configuration., ",
+		"\nYou can also edit the config again by using:", os.Args[0], "config",
+	)
+	os.Exit(0)
+	return nil
+}
+
+// interruptContext is canceled by the first Ctrl-C or SIGTERM, so that the command can stop cleanly. A second one kills the program right away
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx
+}
+
 func showHelp() {
 	s := strings.Repeat(" ", 4)
 
-	fmt.Printf("Usage: %s [help | config | decrypt]\n\n", os.Args[0])
+	fmt.Printf("Usage: %s [help | config | decrypt | list | verify | diff | replicate | prune | estimate]\n\n", os.Args[0])
+	fmt.Printf(
+		"  * %s %s\n%s - Backs up the paths of the config to every destination\n"+
+			"%s - Shows a progress bar on a terminal, nothing with --quiet, or every file with --verbose\n"+
+			"%s - Use --output json to print the results as JSON, with every other message on stderr (also for decrypt, list and verify)\n\n",
+		os.Args[0], usageMsgs["backup"], s, s, s,
+	)
 	fmt.Printf("  * %s %s\n%s - Shows you this message\n\n", os.Args[0], usageMsgs["help"], s)
 	fmt.Printf("  * %s %s\n%s - Lets you edit the program configuration\n\n", os.Args[0], usageMsgs["config"], s)
 
 	fmt.Printf(
 		"  * %s %s\n%s - Decrypts a previous backup file\n"+
+			"%s - Use --include and --exclude (repeatable, \"**\" matches any amount of folders) to only extract some of the files\n"+
+			"%s - Use --in-place to restore the files to their original location, instead of a new folder\n"+
+			"%s - Existing files are overwritten (skipped with --in-place), unless another policy is specified\n"+
+			"%s - Use --dry-run to only print what would be created (+), replaced (~) or skipped (=)\n"+
+			"%s - Shows the progress like the backup, with --quiet and --verbose\n"+
 			"%s - You can also set the private key as an enviroment variable (PRIV_KEY) to avoid pausing\n"+
 			"%s - Please AVOID storing the key as a persistent value and only set it on each execution\n",
-		os.Args[0], usageMsgs["decrypt"], s, s, s,
+		os.Args[0], usageMsgs["decrypt"], s, s, s, s, s, s, s, s,
+	)
+	fmt.Printf(
+		"\n  * %s %s\n%s - Lists the files inside of a backup, without extracting them\n"+
+			"%s - Accepts the same filters as decrypt, and --json prints the list in a machine-readable format\n",
+		os.Args[0], usageMsgs["list"], s, s,
+	)
+	fmt.Printf(
+		"\n  * %s %s\n%s - Checks the macsum, the index and the checksum of a backup, without extracting it\n",
+		os.Args[0], usageMsgs["verify"], s,
+	)
+	fmt.Printf(
+		"\n  * %s %s\n%s - Shows the files added (+), removed (-) or modified (~) since the backup was created\n"+
+			"%s - Compares it to the paths in the config, or to another backup if specified\n"+
+			"%s - Accepts the same filters as decrypt, and --json prints the changes in a machine-readable format\n",
+		os.Args[0], usageMsgs["diff"], s, s, s,
+	)
+	fmt.Printf(
+		"\n  * %s %s\n%s - Copies the backups missing from another destination (a folder, or an sftp://, s3:// or webdav:// url)\n"+
+			"%s - Every backup is verified while being copied, without needing the private key\n"+
+			"%s - The destination follows the retention of the config, or only keeps the newest --keep backups if specified (-1 keeps all)\n",
+		os.Args[0], usageMsgs["replicate"], s, s, s,
+	)
+	fmt.Printf(
+		"\n  * %s %s\n%s - Removes the backups which the retention of the config doesn't keep, from every destination or only the specified one\n"+
+			"%s - Use --dry-run to only print which backups would be removed, and why\n",
+		os.Args[0], usageMsgs["prune"], s, s,
+	)
+	fmt.Printf(
+		"\n  * %s %s\n%s - Shows the size of the files to back up, and whether every destination has enough space for the backup\n",
+		os.Args[0], usageMsgs["estimate"], s,
 	)
 }
 
@@ -53,48 +236,76 @@ func main() {
 }
 
 func run() bool {
-	args := os.Args[1:]
+	args := parseOutput(os.Args[1:])
+	args, display := parseProgress(args)
+	logger := log.New(os.Stdout, "", 0) // Moved to stderr with --output json
 
 	// * Start backup
 	if len(args) == 0 {
-		config, err := configuration.Load()
-		if err != nil {
-			fmt.Println(invalidConfigMsg)
-			os.Exit(1)
-		}
+		config := loadConfig()
 
 		// Decode pubKey
 		pubKey, err := base64.RawStdEncoding.DecodeString(config.Key)
 		if err != nil {
 			fmt.Println("Invalid key in config file")
-			os.Exit(1)
+			os.Exit(EXIT_CONFIG)
 		}
 
 		// Verify key len
 		if len(pubKey) != crypto.PUB_KEY_SIZE {
 			fmt.Println("Invalid key in config file. Is it the right one?")
-			os.Exit(1)
+			os.Exit(EXIT_CONFIG)
 		}
 
-		// Remove older files
-		startingTime := time.Now()
-		os.Mkdir(config.Destination, os.ModePerm)
-		backups.DeleteOldBackups(config.Destination, config.Amount)
-
-		// Create file
-		outFile, err := os.Create(config.Destination + strconv.FormatInt(startingTime.UnixMilli(), 10))
+		// Verify the compression settings
+		settings, err := config.CompressionSettings()
 		if err != nil {
-			panic(err)
+			fmt.Println("Invalid compression in config file:", err)
+			os.Exit(EXIT_CONFIG)
 		}
-		defer outFile.Close()
 
-		// Backup to file
-		fileN, folderN := backups.CreateBackup(outFile, [crypto.PUB_KEY_SIZE]byte(pubKey), config.Paths)
+		// Verify the retention
+		retention := config.Retention()
+		if err := retention.Validate(); err != nil {
+			fmt.Println("Invalid retention in config file:", err)
+			os.Exit(EXIT_CONFIG)
+		}
+
+		// Backup to every destination, then verify it and apply the retention
+		startingTime := time.Now()
+		report, err := backups.Create(interruptContext(), backups.CreateOptions{
+			PublicKey:    [crypto.PUB_KEY_SIZE]byte(pubKey),
+			Paths:        config.Paths,
+			Destinations: config.Destinations,
+			RequireAll:   config.RequireAll,
+			Compression:  settings,
+			Tar:          config.TarOptions(),
+			Retention:    retention,
+			PruneEarly:   config.PruneEarly,
+			Report:       config.Report,
+			Logger:       logger,
+			Progress:     display.report,
+		})
 		crypto.DestroyKey(pubKey)
+		if errors.Is(err, context.Canceled) && report.MAC != "" {
+			exitInterrupted(report, "The backup is complete, but the older ones haven't been removed from the destinations where it hasn't been verified yet")
+		} else if errors.Is(err, context.Canceled) {
+			exitInterrupted(report, "The incomplete backup has been removed from every destination")
+		}
+		if err != nil && !errors.Is(err, backups.ErrBackupFailed) { // Otherwise the destinations have already been reported
+			exitWith(report, "Unable to back up:", err)
+		}
 
 		fmt.Println("\nDone.")
-		fmt.Printf("%d files and %d folders have been affected\n", fileN, folderN)
+		fmt.Printf("%d files and %d folders have been affected\n", report.Files, report.Folders)
 		fmt.Printf("Execution completed in %v\n", time.Since(startingTime).Round(time.Millisecond))
+		printReport(report)
+		if err != nil {
+			if hint := errorHint(err); hint != "" {
+				fmt.Println(hint)
+			}
+			os.Exit(exitStatus(err))
+		}
 		return true
 	}
 
@@ -107,11 +318,7 @@ func run() bool {
 		}
 
 		// Load/Create the config file
-		config, err := configuration.Load()
-		if err != nil {
-			fmt.Println(invalidConfigMsg)
-			os.Exit(1)
-		}
+		config := loadConfig()
 
 		// This wont run if the config has just been created
 		config.OpenEditor()
@@ -126,18 +333,24 @@ func run() bool {
 		}
 
 		// Should it extract the file to a folder
-		extract := true
-		if args[len(args)-1] == "--tar" {
-			extract = false
-			args = args[:len(args)-1]
+		args, onlyTar := popFlag(args, "--tar")
+		extract := !onlyTar
+
+		// Which files should be extracted, and where
+		args, filter := parseFilter(args, usageMsg)
+		args, inPlace := popFlag(args, "--in-place")
+		args, dryRun := popFlag(args, "--dry-run")
+		args, conflict := parseConflict(args, inPlace)
+		if !extract && (!filter.IsEmpty() || inPlace || dryRun) {
+			fmt.Println("--tar can only be used to decompress the whole backup")
+			os.Exit(1)
 		}
-		if args[0] == "--tar" {
-			extract = false
-			args = args[1:]
+		if dryRun && !display.explicit { // The list of files is the point of a dry run
+			display.mode = progressVerbose
 		}
 
 		// Validate the arguments
-		if len(args) == 0 || len(args) > 2 {
+		if len(args) == 0 || len(args) > 2 || (inPlace && len(args) == 2) {
 			fmt.Println(usageMsg)
 			return true
 		}
@@ -149,39 +362,392 @@ func run() bool {
 			destination = parsePath(args[1])
 		}
 
-		// Ask for the private key
-		b64PrivKey := strings.Trim(os.Getenv("PRIV_KEY"), " ") // Checks if stored
-		if b64PrivKey == "" {
-			fmt.Println("Copy the private key to the clipboard and press Enter...")
-			fmt.Scanln() // Wait for user to confirm they copied it
+		privKey, ok := readPrivKey()
+		if !ok {
+			return false
+		}
 
-			content, err := glippy.Get()
-			if err != nil {
-				fmt.Println("Clipboard access not supported")
-				fmt.Println("Please use the env variabile instead (PRIV_KEY)")
-				return false
+		// Decrypt the backup
+		startingTime := time.Now()
+		report := backups.NewReport("decrypt")
+		report.Backup = target
+		stats, err := backups.Restore(interruptContext(), backups.RestoreOptions{
+			RestoreOptions: archive.RestoreOptions{
+				Destination: destination,
+				InPlace:     inPlace,
+				Conflict:    conflict,
+				DryRun:      dryRun,
+				Filter:      filter,
+				Progress:    display.report,
+			},
+			Backup:     target,
+			PrivateKey: privKey,
+			TarOnly:    !extract,
+			Logger:     logger,
+		})
+		crypto.DestroyKey(privKey)
+		if errors.Is(err, context.Canceled) && !extract {
+			exitInterrupted(report, "The incomplete archive has been removed")
+		} else if errors.Is(err, context.Canceled) {
+			exitInterrupted(report, "Files are only moved into place once complete. Run the same command again to continue the restore")
+		}
+		if err != nil {
+			exitWith(report, "Unable to decrypt the backup:", err)
+		}
+
+		fmt.Println("Done.")
+		if extract {
+			fmt.Printf("%d files and %d folders have been affected\n", stats.Files, stats.Folders)
+			fmt.Printf("%d created, %d replaced, %d skipped and %d renamed\n", stats.Created, stats.Replaced, stats.Skipped, stats.Renamed)
+		}
+		if dryRun {
+			fmt.Println("This was a dry run, nothing has been written")
+		}
+		fmt.Printf("Execution completed in %v\n", time.Since(startingTime).Round(time.Millisecond))
+
+		report.Files, report.Folders, report.BytesOut = stats.Files, stats.Folders, stats.Bytes
+		if jsonOutput != nil {
+			if object, err := storage.OpenFile(target); err == nil {
+				report.BytesIn = object.Size()
+				object.Close()
 			}
-			b64PrivKey = content
 		}
+		if extract {
+			report.Restore = &stats
+		}
+		printReport(report)
+		return true
 
-		// Verifies it
-		privKey, err := base64.RawStdEncoding.DecodeString(b64PrivKey)
-		if err != nil || len(privKey) != crypto.PRIV_KEY_SIZE {
-			fmt.Println("Invalid key")
+	case "list":
+		usageMsg := "Usage: " + os.Args[0] + " " + usageMsgs["list"]
+		args, asJson := popFlag(args[1:], "--json")
+		args, filter := parseFilter(args, usageMsg)
+		if len(args) != 1 {
+			fmt.Println(usageMsg)
 			os.Exit(1)
 		}
-		crypto.DestroyKeyString(&b64PrivKey) // Works poorly but it's not really required, so we'll leave it here
+		target := parsePath(args[0])
 
-		// Decrypt the backup
-		startingTime := time.Now()
-		fileN, folderN := backups.DecryptBackup(target, destination, privKey, extract)
+		privKey, ok := readPrivKey()
+		if !ok {
+			return false
+		}
+
+		// List the backup
+		report := backups.NewReport("list")
+		report.Backup = target
+		entries := []archive.Entry{}
+		logger := log.New(os.Stderr, "", 0) // Keeps stdout for the entries
+		fileN, folderN, err := backups.ListBackup(target, privKey, filter, logger, func(entry archive.Entry) {
+			if asJson || jsonOutput != nil {
+				entries = append(entries, entry)
+				return
+			}
+
+			size := strings.Repeat(" ", 6) + "-"
+			if !entry.IsDir {
+				size = archive.FormatByteCount(entry.Size)
+			}
+			fmt.Printf("%s  [%s]  %s  %s\n", entry.Mode, size, entry.ModTime.Format(time.DateTime), entry.Name)
+		})
 		crypto.DestroyKey(privKey)
+		if err != nil {
+			exitWith(report, "Unable to list the backup:", err)
+		}
 
-		fmt.Println("Done.")
-		if extract {
-			fmt.Printf("%d files and %d folders have been affected\n", fileN, folderN)
+		if jsonOutput != nil {
+			report.Files, report.Folders, report.Entries = fileN, folderN, entries
+			printReport(report)
+			return true
+		}
+		if asJson {
+			out, _ := json.MarshalIndent(entries, "", "  ")
+			fmt.Println(string(out))
+			return true
 		}
+		fmt.Printf("\n%d files and %d folders\n", fileN, folderN)
+		return true
+
+	case "verify":
+		if len(args) != 2 {
+			fmt.Println("Usage:", os.Args[0], usageMsgs["verify"])
+			os.Exit(1)
+		}
+		target := parsePath(args[1])
+
+		privKey, ok := readPrivKey()
+		if !ok {
+			return false
+		}
+
+		// Read the whole backup once, checking its macsum, index and checksum
+		report := backups.NewReport("verify")
+		report.Backup = target
+		fmt.Println("Verifying the backup...")
+		result, err := backups.VerifyBackup(target, privKey, display.report)
+		crypto.DestroyKey(privKey)
+		if err != nil {
+			exitWith(report, "The backup is invalid:", err)
+		}
+
+		report.BytesIn, report.Codec, report.MAC = result.Size, result.Codec, hex.EncodeToString(result.MAC)
+		report.Files, report.Folders = result.Files, result.Folders
+		fmt.Printf("The backup is valid (%s, %s)\n", archive.FormatByteCount(result.Size), result.Codec)
+		fmt.Println("  - Macsum:", report.MAC)
+		if result.Indexed {
+			fmt.Printf("  - Index: verified, %d files and %d folders\n", result.Files, result.Folders)
+		}
+		if result.Checksum {
+			fmt.Println("  - Checksum: verified")
+		} else {
+			fmt.Println("  - Checksum: none, the backup has been created by an older version")
+		}
+		fmt.Printf("Execution completed in %v\n", time.Since(report.Started).Round(time.Millisecond))
+		printReport(report)
+		return true
+
+	case "diff":
+		usageMsg := "Usage: " + os.Args[0] + " " + usageMsgs["diff"]
+		args, asJson := popFlag(args[1:], "--json")
+		args, filter := parseFilter(args, usageMsg)
+		if len(args) == 0 || len(args) > 2 {
+			fmt.Println(usageMsg)
+			os.Exit(1)
+		}
+
+		// Without a second backup, compare it to what is currently on disk
+		var paths []string
+		if len(args) == 1 {
+			config := loadConfig()
+			paths = config.Paths
+		}
+
+		privKey, ok := readPrivKey()
+		if !ok {
+			return false
+		}
+
+		logger := log.New(os.Stderr, "", 0) // Keeps stdout for the changes
+		old, err := backups.SnapshotBackup(parsePath(args[0]), privKey, filter, logger)
+		var newer *archive.Snapshot
+		if err == nil && len(args) == 2 {
+			newer, err = backups.SnapshotBackup(parsePath(args[1]), privKey, filter, logger)
+		}
+		crypto.DestroyKey(privKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read the backup:", err)
+			os.Exit(exitStatus(err))
+		}
+		if newer == nil {
+			if newer, err = archive.ScanSnapshot(paths, filter); err != nil {
+				fmt.Fprintln(os.Stderr, "Unable to read the paths in the config:", err)
+				os.Exit(exitStatus(err))
+			}
+		}
+
+		changes, err := archive.Diff(old, newer)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to compare the files:", err)
+			os.Exit(1)
+		}
+
+		if asJson {
+			out, _ := json.MarshalIndent(changes, "", "  ")
+			fmt.Println(string(out))
+			return true
+		}
+
+		symbols := map[string]string{archive.CHANGE_ADDED: "+", archive.CHANGE_REMOVED: "-", archive.CHANGE_MODIFIED: "~"}
+		for _, change := range changes {
+			if len(change.Reasons) > 0 {
+				fmt.Printf("%s %s (%s)\n", symbols[change.Kind], change.Name, strings.Join(change.Reasons, ", "))
+			} else {
+				fmt.Printf("%s %s\n", symbols[change.Kind], change.Name)
+			}
+		}
+		fmt.Printf("\n%d changes\n", len(changes))
+		return true
+
+	case "replicate":
+		usageMsg := "Usage: " + os.Args[0] + " " + usageMsgs["replicate"]
+		args, keep, err := popValues(args[1:], "--keep")
+		if err != nil || len(args) != 2 || len(keep) > 1 {
+			fmt.Println(usageMsg)
+			os.Exit(1)
+		}
+
+		// Use the retention of the config, unless an amount is specified
+		var retention backups.Retention
+		if len(keep) == 1 {
+			if retention.Last, err = strconv.Atoi(keep[0]); err != nil || retention.Last < -1 || retention.Last == 0 {
+				fmt.Println("Invalid amount of backups to keep:", keep[0])
+				os.Exit(1)
+			}
+		} else {
+			config := loadConfig()
+			retention = config.Retention()
+			if err := retention.Validate(); err != nil {
+				fmt.Println("Invalid retention in config file:", err)
+				os.Exit(EXIT_CONFIG)
+			}
+		}
+
+		startingTime := time.Now()
+		src, err := storage.Open(parsePath(args[0]))
+		if err != nil {
+			fmt.Println("Can't open the source:", err)
+			os.Exit(1)
+		}
+		defer src.Close()
+		dest, err := storage.Open(parsePath(args[1]))
+		if err != nil {
+			fmt.Println("Can't open the destination:", err)
+			os.Exit(1)
+		}
+		defer dest.Close()
+
+		fmt.Printf("Replicating %s to %s\n\n", src, dest)
+		stats, err := backups.Replicate(src, dest, retention, logger)
+		if err != nil {
+			fmt.Println("Unable to replicate the backups:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("\nDone.")
+		fmt.Printf("%d copied, %d already present, %d failed and %d removed\n", stats.Copied, stats.Present, stats.Failed, stats.Removed)
 		fmt.Printf("Execution completed in %v\n", time.Since(startingTime).Round(time.Millisecond))
+		if stats.Failed > 0 {
+			os.Exit(1)
+		}
+		return true
+
+	case "estimate":
+		if len(args) != 1 {
+			fmt.Println("Usage:", os.Args[0], usageMsgs["estimate"])
+			os.Exit(1)
+		}
+		config := loadConfig()
+		retention := config.Retention()
+		if err := retention.Validate(); err != nil {
+			fmt.Println("Invalid retention in config file:", err)
+			os.Exit(EXIT_CONFIG)
+		}
+
+		size, fileN, folderN, err := archive.Size(config.Paths)
+		if err != nil {
+			fmt.Println("Unable to read the paths in the config:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d files and %d folders to back up, %s in total\n", fileN, folderN, archive.FormatByteCount(size))
+
+		failed := 0
+		for _, location := range config.Destinations {
+			dest, err := storage.Open(location)
+			if err != nil {
+				fmt.Printf("\nCan't open the destination %s: %v\n", storage.Redact(location), err)
+				failed++
+				continue
+			}
+			estimate, err := backups.EstimateBackup(dest, retention, size)
+			dest.Close()
+			if err != nil {
+				fmt.Printf("\nUnable to estimate the backup in %s: %v\n", dest, err)
+				failed++
+				continue
+			}
+
+			fmt.Printf("\n%s\n", dest)
+			if estimate.Free != -1 {
+				fmt.Printf("  Free space:      %s\n", archive.FormatByteCount(estimate.Free))
+			} else {
+				fmt.Println("  Free space:      unknown")
+			}
+			if estimate.Previous > 0 {
+				fmt.Printf("  Previous backup: %s\n", archive.FormatByteCount(estimate.Previous))
+			}
+			fmt.Printf("  Estimated size:  %s\n", archive.FormatByteCount(estimate.Needed))
+			fmt.Printf("  Retention:       %d older backups (%s) removed afterwards\n", len(estimate.Prunable), archive.FormatByteCount(estimate.Reclaimable()))
+
+			switch {
+			case estimate.Free == -1:
+				fmt.Println("  The free space can't be checked")
+			case estimate.Fits():
+				fmt.Println("  Enough space")
+			case estimate.FitsAfterPruning() && config.PruneEarly:
+				fmt.Println("  Enough space, once the older backups are removed first")
+			case estimate.FitsAfterPruning():
+				fmt.Println("  Not enough space: the destination will be skipped, unless prune early is enabled in the config")
+				failed++
+			default:
+				fmt.Printf("  Not enough space: %s missing\n", archive.FormatByteCount(estimate.Needed-estimate.Free-estimate.Reclaimable()))
+				failed++
+			}
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return true
+
+	case "prune":
+		usageMsg := "Usage: " + os.Args[0] + " " + usageMsgs["prune"]
+		args, dryRun := popFlag(args[1:], "--dry-run")
+		if len(args) > 1 {
+			fmt.Println(usageMsg)
+			os.Exit(1)
+		}
+		config := loadConfig()
+
+		// Every destination in the config, unless specified
+		locations := config.Destinations
+		if len(args) == 1 {
+			locations = []string{parsePath(args[0])}
+		}
+
+		retention := config.Retention()
+		if err := retention.Validate(); err != nil {
+			fmt.Println("Invalid retention in config file:", err)
+			os.Exit(EXIT_CONFIG)
+		}
+		fmt.Println(retention)
+		failed, count, size, legacy := 0, 0, int64(0), 0
+		for _, location := range locations {
+			dest, err := storage.Open(location)
+			if err != nil {
+				fmt.Printf("\nCan't open the destination %s: %v\n", storage.Redact(location), err)
+				failed++
+				continue
+			}
+			fmt.Printf("\n%s\n", dest)
+			removals, skipped, err := backups.Prune(dest, retention, dryRun)
+			dest.Close()
+			legacy += len(skipped)
+			for _, removal := range removals {
+				if removal.Err != nil {
+					fmt.Printf("! %s: unable to remove it (%v)\n", removal.Name, removal.Err)
+					failed++
+					continue
+				}
+				fmt.Printf("- %s (%s): %s\n", removal.Name, archive.FormatByteCount(removal.Size), removal.Reason)
+				count++
+				size += removal.Size
+			}
+			if err != nil {
+				fmt.Println("Unable to prune the destination:", err)
+				failed++
+			}
+		}
+
+		if dryRun {
+			fmt.Printf("\n%d backups (%s) would be removed\n", count, archive.FormatByteCount(size))
+		} else {
+			fmt.Printf("\n%d backups (%s) removed\n", count, archive.FormatByteCount(size))
+		}
+		if legacy > 0 {
+			fmt.Println(backups.LegacyWarning(legacy))
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
 		return true
 	}
 
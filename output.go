@@ -0,0 +1,44 @@
+package main
+
+import (
+	"backupusb/backups"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// jsonOutput is where the report goes with --output json. Every other message is moved to stderr, so that stdout only contains the JSON
+var jsonOutput *os.File
+
+// parseOutput removes the --output flag from the arguments
+func parseOutput(args []string) []string {
+	args, formats, err := popValues(args, "--output")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(formats) == 0 {
+		return args
+	}
+
+	switch formats[len(formats)-1] {
+	case "text":
+	case "json":
+		jsonOutput = os.Stdout
+		os.Stdout = os.Stderr
+	default:
+		fmt.Println("Invalid output format, it can either be text or json")
+		os.Exit(1)
+	}
+	return args
+}
+
+// printReport prints the report, only with --output json
+func printReport(report *backups.Report) {
+	if jsonOutput == nil {
+		return
+	}
+	report.Finish()
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(jsonOutput, string(out))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"backupusb/archive"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const BAR_WIDTH = 10
+const REDRAW_INTERVAL = 200 * time.Millisecond
+
+// progressMode is how the progress of a backup, verification or restore is shown
+type progressMode int
+
+const (
+	progressBar     progressMode = iota // A single line redrawn in place, only on a terminal
+	progressQuiet                       // Nothing
+	progressVerbose                     // A line for every file
+)
+
+var stageNames = map[archive.Stage]string{
+	archive.STAGE_BACKUP:  "Backup",
+	archive.STAGE_VERIFY:  "Verify",
+	archive.STAGE_RESTORE: "Restore",
+}
+
+type progressDisplay struct {
+	mode     progressMode
+	explicit bool // Chosen with --quiet or --verbose
+	drawn    time.Time
+}
+
+// parseProgress removes the --quiet and --verbose flags from the arguments
+func parseProgress(args []string) ([]string, *progressDisplay) {
+	args, quiet := popFlag(args, "--quiet")
+	args, verbose := popFlag(args, "--verbose")
+	if quiet && verbose {
+		fmt.Println("Only one of --quiet and --verbose can be used")
+		os.Exit(1)
+	}
+
+	display := &progressDisplay{mode: progressBar, explicit: quiet || verbose}
+	if quiet || (!verbose && !term.IsTerminal(int(os.Stdout.Fd()))) { // The bar would only clutter logs
+		display.mode = progressQuiet
+	} else if verbose {
+		display.mode = progressVerbose
+	}
+	return args, display
+}
+
+// report is the archive.ProgressFunc of the display
+func (d *progressDisplay) report(p archive.Progress) {
+	switch d.mode {
+	case progressVerbose:
+		if p.Line != "" {
+			fmt.Println(p.Line)
+		}
+	case progressBar:
+		if !p.Final && time.Since(d.drawn) < REDRAW_INTERVAL {
+			return
+		}
+		d.drawn = time.Now()
+		fmt.Print("\r" + fitLine(formatProgress(p)) + "\x1b[K")
+		if p.Final {
+			fmt.Println()
+		}
+	}
+}
+
+// formatProgress describes the progress in a single line (ex. "Backup  45% [####------] 1.20 GB/2.65 GB, ...")
+func formatProgress(p archive.Progress) string {
+	line := stageNames[p.Stage]
+	if p.Total > 0 {
+		done := min(float64(p.Bytes)/float64(p.Total), 1)
+		filled := int(done * BAR_WIDTH)
+		line += fmt.Sprintf(" %3.0f%% [%s%s] %s/%s", done*100, strings.Repeat("#", filled), strings.Repeat("-", BAR_WIDTH-filled),
+			compactBytes(min(p.Bytes, p.Total)), compactBytes(p.Total))
+	} else {
+		line += " " + compactBytes(p.Bytes)
+	}
+
+	if p.TotalEntries > 0 {
+		line += fmt.Sprintf(", %d/%d files", min(p.Entries, p.TotalEntries), p.TotalEntries)
+	} else if p.Entries > 0 {
+		line += fmt.Sprintf(", %d files", p.Entries)
+	}
+	line += ", " + compactBytes(int64(p.Throughput())) + "/s"
+
+	if p.Final {
+		line += ", done in " + p.Elapsed.Round(time.Second).String()
+	} else if eta := p.ETA(); eta >= 0 {
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+	if p.Current != "" {
+		line += "  " + p.Current
+	}
+	return line
+}
+
+// compactBytes formats the byte count without the padding of archive.FormatByteCount
+func compactBytes(b int64) string {
+	return strings.Join(strings.Fields(archive.FormatByteCount(b)), " ")
+}
+
+// fitLine cuts the line to the width of the terminal, so that it can be redrawn in place
+func fitLine(line string) string {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	if runes := []rune(line); len(runes) >= width {
+		return string(runes[:width-1])
+	}
+	return line
+}
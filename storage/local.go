@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Local stores the backups in a folder, usually on the usb stick itself
+type Local struct {
+	Dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Local{Dir: dir}, nil
+}
+
+// Create writes to a temporary file, which is renamed once complete
+func (l *Local) Create(name string) (Upload, error) {
+	path := filepath.Join(l.Dir, name)
+	file, err := os.Create(path + TEMP_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	return &localUpload{File: file, path: path}, nil
+}
+
+func (l *Local) CreateResumable(name string) (ResumableUpload, error) {
+	path := filepath.Join(l.Dir, name)
+	file, err := os.Create(path + PARTIAL_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	return &localResumable{file: file, path: path}, nil
+}
+
+func (l *Local) ResumeUpload(name string, offset int64) (ResumableUpload, error) {
+	path := filepath.Join(l.Dir, name)
+	file, err := os.OpenFile(path+PARTIAL_SUFFIX, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := resumeAt(file, offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localResumable{file: file, path: path, written: offset}, nil
+}
+
+// resumeAt drops whatever has been written after offset, and continues from there
+func resumeAt(file interface {
+	io.Seeker
+	Stat() (os.FileInfo, error)
+	Truncate(int64) error
+}, offset int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset {
+		return fmt.Errorf("the interrupted upload only has %d bytes out of %d", info.Size(), offset)
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (l *Local) Open(name string) (Object, error) {
+	return openLocal(filepath.Join(l.Dir, name))
+}
+
+func openLocal(path string) (Object, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localObject{file, info.Size()}, nil
+}
+
+func (l *Local) List() ([]Info, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue // Removed in the meantime
+		}
+		infos = append(infos, Info{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return infos, nil
+}
+
+func (l *Local) Remove(name string) error {
+	return os.Remove(filepath.Join(l.Dir, name))
+}
+
+func (l *Local) Close() error {
+	return nil
+}
+
+func (l *Local) String() string {
+	return l.Dir
+}
+
+type localObject struct {
+	*os.File
+	size int64
+}
+
+func (o *localObject) Size() int64 {
+	return o.size
+}
+
+type localUpload struct {
+	*os.File
+	path string
+}
+
+func (u *localUpload) Close() error {
+	if err := u.File.Sync(); err != nil {
+		u.File.Close()
+		return err
+	}
+	if err := u.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(u.path+TEMP_SUFFIX, u.path)
+}
+
+func (u *localUpload) Abort() error {
+	u.File.Close()
+	return os.Remove(u.path + TEMP_SUFFIX)
+}
+
+// localResumable writes to the partial file, which is renamed once complete
+type localResumable struct {
+	file    *os.File
+	path    string
+	written int64
+}
+
+func (u *localResumable) Write(p []byte) (int, error) {
+	n, err := u.file.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+func (u *localResumable) Sync() (int64, error) {
+	return u.written, u.file.Sync()
+}
+
+func (u *localResumable) Close() error {
+	if _, err := u.Sync(); err != nil {
+		u.file.Close()
+		return err
+	}
+	if err := u.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(u.path+PARTIAL_SUFFIX, u.path)
+}
+
+func (u *localResumable) Pause() error {
+	return u.file.Close()
+}
+
+func (u *localResumable) Abort() error {
+	u.file.Close()
+	return os.Remove(u.path + PARTIAL_SUFFIX)
+}
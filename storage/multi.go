@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Target is one of the destinations of a MultiUpload, and how its upload went
+type Target struct {
+	Name   string
+	Err    error // Why it failed, nil if the backup has been stored
+	upload Upload
+	closed bool
+}
+
+// MultiUpload sends the same backup to several destinations at once. A failing destination is dropped while the others carry on,
+// unless every one of them is required to succeed
+type MultiUpload struct {
+	targets    []*Target
+	requireAll bool
+}
+
+func NewMultiUpload(requireAll bool) *MultiUpload {
+	return &MultiUpload{requireAll: requireAll}
+}
+
+// Add sends the backup to the upload too
+func (m *MultiUpload) Add(name string, upload Upload) {
+	m.targets = append(m.targets, &Target{Name: name, upload: upload})
+}
+
+// Fail records a destination that couldn't even be opened, so that it's reported along with the others
+func (m *MultiUpload) Fail(name string, err error) {
+	m.targets = append(m.targets, &Target{Name: name, Err: err, closed: true})
+}
+
+// Targets returns every destination, in the order they were added
+func (m *MultiUpload) Targets() []*Target {
+	return m.targets
+}
+
+// Failed returns the amount of destinations which failed
+func (m *MultiUpload) Failed() int {
+	failed := 0
+	for _, target := range m.targets {
+		if target.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// err returns the error of the whole upload, if the policy isn't met anymore
+func (m *MultiUpload) err() error {
+	failed := m.Failed()
+	if failed == 0 || (!m.requireAll && failed < len(m.targets)) {
+		return nil
+	}
+
+	errs := []error{}
+	for _, target := range m.targets {
+		if target.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", target.Name, target.Err)) // Still wrapped, so that the cause can be told (ex. a full disk)
+		}
+	}
+	if m.requireAll {
+		return errors.Join(append([]error{errors.New("a destination failed")}, errs...)...)
+	}
+	return errors.Join(append([]error{errors.New("every destination failed")}, errs...)...)
+}
+
+// each runs fn on every destination still going, concurrently, so that a slow one doesn't hold back the others
+func (m *MultiUpload) each(fn func(upload Upload) error) {
+	var wg sync.WaitGroup
+	for _, target := range m.targets {
+		if target.Err != nil || target.closed {
+			continue
+		}
+		wg.Go(func() {
+			if err := fn(target.upload); err != nil {
+				target.Err = err
+				target.closed = true
+				target.upload.Abort()
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func (m *MultiUpload) Write(p []byte) (int, error) {
+	if err := m.err(); err != nil {
+		return 0, err
+	}
+	m.each(func(upload Upload) error {
+		_, err := upload.Write(p)
+		return err
+	})
+	if err := m.err(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync persists what has been written to the destinations which support it
+func (m *MultiUpload) Sync() error {
+	if err := m.err(); err != nil {
+		return err
+	}
+	m.each(func(upload Upload) error {
+		if syncer, ok := upload.(Syncer); ok {
+			return syncer.Sync()
+		}
+		return nil
+	})
+	return m.err()
+}
+
+// Close completes every upload. It only fails if the policy isn't met, the other failures are reported by Targets
+func (m *MultiUpload) Close() error {
+	m.each(func(upload Upload) error {
+		return upload.Close()
+	})
+	for _, target := range m.targets {
+		target.closed = true
+	}
+	return m.err()
+}
+
+// Abort discards the uploads still going, while the completed ones are kept
+func (m *MultiUpload) Abort() error {
+	for _, target := range m.targets {
+		if !target.closed {
+			target.closed = true
+			target.upload.Abort()
+		}
+	}
+	return nil
+}
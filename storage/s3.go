@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3_PART_SIZE is the size of each part of the multipart uploads, which are kept in memory while being sent
+const S3_PART_SIZE = 64 << 20
+
+// S3_MAX_SIZE is the size a backup must stay below, since S3 allows up to 10000 parts (625GiB)
+const S3_MAX_SIZE = S3_PART_SIZE * 10000
+
+var errTooBig = fmt.Errorf("the backup is too big for S3, which allows up to 10000 parts of %dMiB", S3_PART_SIZE>>20)
+
+var errUploadAborted = errors.New("upload aborted")
+
+// S3 stores the backups in a bucket of any S3 compatible storage (AWS, MinIO...), optionally under a prefix
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string // Empty, or ending with a /
+}
+
+// NewS3 uses an already configured client. The bucket must already exist
+func NewS3(client *minio.Client, bucket, prefix string) (*S3, error) {
+	exists, err := client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("the bucket " + bucket + " doesn't exist")
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// DialS3 connects to s3://[access:secret@]host[:port]/bucket[/prefix]. Without credentials in the url,
+// they are taken from the environment (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or MINIO_ACCESS_KEY and MINIO_SECRET_KEY).
+// The region query value sets the region, and insecure uses http instead of https
+func DialS3(u *url.URL) (*S3, error) {
+	var creds *credentials.Credentials
+	if secret, ok := u.User.Password(); ok {
+		creds = credentials.NewStaticV4(u.User.Username(), secret, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}})
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  creds,
+		Secure: !u.Query().Has("insecure"),
+		Region: u.Query().Get("region"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, errors.New("missing bucket in " + u.Redacted())
+	}
+	return NewS3(client, bucket, prefix)
+}
+
+func (s *S3) Create(name string) (Upload, error) {
+	reader, writer := io.Pipe()
+	upload := &s3Upload{pipe: writer, done: make(chan error, 1)}
+
+	// The size isn't known in advance, so the object is sent as a multipart upload, one part at a time
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, s.prefix+name, reader, -1, minio.PutObjectOptions{
+			PartSize:             S3_PART_SIZE,
+			ContentType:          "application/octet-stream",
+			DisableContentSha256: true, // The backup has its own macsum, no need to hash every part too
+		})
+		reader.CloseWithError(err) // Unblocks the writer if the upload failed
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+// CreateResumable starts a multipart upload, which is kept by the server until completed or aborted
+func (s *S3) CreateResumable(name string) (ResumableUpload, error) {
+	core := minio.Core{Client: s.client}
+	uploadID, err := core.NewMultipartUpload(context.Background(), s.bucket, s.prefix+name, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Resumable{core: core, bucket: s.bucket, key: s.prefix + name, uploadID: uploadID}, nil
+}
+
+// ResumeUpload finds the latest multipart upload of name, keeping the parts up to offset
+func (s *S3) ResumeUpload(name string, offset int64) (ResumableUpload, error) {
+	core := minio.Core{Client: s.client}
+	key := s.prefix + name
+	uploads, err := core.ListMultipartUploads(context.Background(), s.bucket, key, "", "", "", 1000)
+	if err != nil {
+		return nil, err
+	}
+	var latest *minio.ObjectMultipartInfo
+	for i, upload := range uploads.Uploads {
+		if upload.Key == key && (latest == nil || upload.Initiated.After(latest.Initiated)) {
+			latest = &uploads.Uploads[i]
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("the interrupted upload doesn't exist anymore")
+	}
+
+	// Only the parts sent before the checkpoint are kept, the following ones will be replaced
+	u := &s3Resumable{core: core, bucket: s.bucket, key: key, uploadID: latest.UploadID}
+	for marker := 0; u.stored < offset; {
+		parts, err := core.ListObjectParts(context.Background(), s.bucket, key, latest.UploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts.ObjectParts {
+			if u.stored == offset || part.PartNumber != len(u.parts)+1 || part.Size != S3_PART_SIZE {
+				break
+			}
+			u.parts = append(u.parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+			u.stored += part.Size
+		}
+		if !parts.IsTruncated || len(parts.ObjectParts) == 0 {
+			break
+		}
+		marker = parts.NextPartNumberMarker
+	}
+	if u.stored != offset {
+		return nil, fmt.Errorf("the interrupted upload only has %d bytes out of %d", u.stored, offset)
+	}
+	return u, nil
+}
+
+func (s *S3) Open(name string) (Object, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return &s3Object{object, info.Size}, nil
+}
+
+// List only returns the objects directly under the prefix
+func (s *S3) List() ([]Info, error) {
+	infos := []Info{}
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimPrefix(object.Key, s.prefix)
+		if name == "" || strings.HasSuffix(name, "/") { // Folders
+			continue
+		}
+		infos = append(infos, Info{Name: name, Size: object.Size, ModTime: object.LastModified})
+	}
+	return infos, nil
+}
+
+func (s *S3) Remove(name string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.prefix+name, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Close() error {
+	return nil
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.client.EndpointURL().Host + "/" + s.bucket + "/" + s.prefix
+}
+
+type s3Object struct {
+	*minio.Object
+	size int64
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
+
+type s3Upload struct {
+	pipe    *io.PipeWriter
+	done    chan error
+	written int64
+}
+
+// Write fails before the last part allowed is full, otherwise the upload would be completed without the rest of the backup
+func (u *s3Upload) Write(p []byte) (int, error) {
+	if u.written+int64(len(p)) >= S3_MAX_SIZE {
+		return 0, errTooBig
+	}
+	n, err := u.pipe.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+// Close waits for the last part to be sent, and for the upload to be completed
+func (u *s3Upload) Close() error {
+	u.pipe.Close()
+	return <-u.done
+}
+
+// Abort makes the upload fail, so that the parts already sent are discarded
+func (u *s3Upload) Abort() error {
+	u.pipe.CloseWithError(errUploadAborted)
+	<-u.done
+	return nil
+}
+
+// s3Resumable sends every part as soon as it's full, so that they can be resumed from
+type s3Resumable struct {
+	core     minio.Core
+	bucket   string
+	key      string
+	uploadID string
+	parts    []minio.CompletePart
+	buf      []byte
+	stored   int64 // Size of the parts already sent
+}
+
+func (u *s3Resumable) Write(p []byte) (int, error) {
+	if u.stored+int64(len(u.buf)+len(p)) >= S3_MAX_SIZE {
+		return 0, errTooBig
+	}
+	written := 0
+	for len(p) > 0 {
+		if u.buf == nil {
+			u.buf = make([]byte, 0, S3_PART_SIZE)
+		}
+		n := min(len(p), S3_PART_SIZE-len(u.buf))
+		u.buf = append(u.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(u.buf) == S3_PART_SIZE {
+			if err := u.sendPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (u *s3Resumable) sendPart() error {
+	number := len(u.parts) + 1
+	part, err := u.core.PutObjectPart(context.Background(), u.bucket, u.key, u.uploadID, number, bytes.NewReader(u.buf), int64(len(u.buf)),
+		minio.PutObjectPartOptions{DisableContentSha256: true})
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	u.stored += int64(len(u.buf))
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// Sync can only resume from the parts already sent, since every part but the last one has to be full
+func (u *s3Resumable) Sync() (int64, error) {
+	return u.stored, nil
+}
+
+func (u *s3Resumable) Close() error {
+	if len(u.buf) > 0 || len(u.parts) == 0 {
+		if err := u.sendPart(); err != nil {
+			return err
+		}
+	}
+	_, err := u.core.CompleteMultipartUpload(context.Background(), u.bucket, u.key, u.uploadID, u.parts, minio.PutObjectOptions{})
+	return err
+}
+
+func (u *s3Resumable) Pause() error {
+	return nil
+}
+
+func (u *s3Resumable) Abort() error {
+	return u.core.AbortMultipartUpload(context.Background(), u.bucket, u.key, u.uploadID)
+}
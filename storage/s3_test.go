@@ -0,0 +1,407 @@
+package storage_test
+
+import (
+	"backupusb/storage"
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory S3 server, with a single bucket and only what the client of the destination uses: simple and multipart uploads,
+// listings, ranged reads and removals. Requests aren't authenticated
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]*fakeUpload // By upload id
+	nextID  int
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+type s3Part struct {
+	PartNumber   int
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readBody returns the content of the request, decoding the aws-chunked encoding used by the client to send checksums as trailers
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	body := bufio.NewReader(r.Body)
+	data := []byte{}
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 { // The trailers follow
+			return data, nil
+		}
+		chunk := make([]byte, size+2) // With the ending \r\n
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	out, _ := xml.Marshal(v)
+	w.Write(append([]byte(xml.Header), out...))
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && query.Has("uploads"):
+		s.listUploads(w, query.Get("prefix"))
+	case key == "" && r.Method == http.MethodGet:
+		s.listObjects(w, query.Get("prefix"), query.Get("delimiter"))
+	case query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &fakeUpload{key: key, initiated: time.Now(), parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case query.Has("uploadId"):
+		s.multipart(w, r, key, query)
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, ok := s.objects[key]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", etag(data))
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	status := http.StatusOK
+	start, end := int64(0), int64(len(data))-1
+	if ranges, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+		first, last, _ := strings.Cut(ranges, "-")
+		start, _ = strconv.ParseInt(first, 10, 64)
+		if last != "" {
+			end, _ = strconv.ParseInt(last, 10, 64)
+			end = min(end, int64(len(data))-1)
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data[start : end+1])
+	}
+}
+
+func (s *fakeS3) listObjects(w http.ResponseWriter, prefix, delimiter string) {
+	type content struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified time.Time
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: s.bucket, Prefix: prefix}
+
+	keys := []string{}
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			folder := prefix + rest[:i+len(delimiter)]
+			if !slices.Contains(result.CommonPrefixes, commonPrefix{folder}) {
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{folder})
+			}
+			continue
+		}
+		data := s.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, Size: int64(len(data)), ETag: etag(data), LastModified: time.Now().UTC()})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+func (s *fakeS3) listUploads(w http.ResponseWriter, prefix string) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated time.Time
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		Prefix      string
+		IsTruncated bool
+		Upload      []upload
+	}{Bucket: s.bucket, Prefix: prefix}
+	for id, u := range s.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			result.Upload = append(result.Upload, upload{Key: u.key, UploadId: id, Initiated: u.initiated})
+		}
+	}
+	writeXML(w, result)
+}
+
+// multipart handles the requests about an upload: sending or listing its parts, completing it or aborting it
+func (s *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string, query url.Values) {
+	id := query.Get("uploadId")
+	upload, ok := s.uploads[id]
+	if !ok || upload.key != key {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || number < 1 || number > 10000 {
+			s3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		upload.parts[number] = data
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet:
+		marker, _ := strconv.Atoi(query.Get("part-number-marker"))
+		result := struct {
+			XMLName              xml.Name `xml:"ListPartsResult"`
+			Bucket               string
+			Key                  string
+			UploadId             string
+			PartNumberMarker     int
+			NextPartNumberMarker int
+			IsTruncated          bool
+			Part                 []s3Part
+		}{Bucket: s.bucket, Key: key, UploadId: id, PartNumberMarker: marker}
+		numbers := []int{}
+		for number := range upload.parts {
+			if number > marker {
+				numbers = append(numbers, number)
+			}
+		}
+		slices.Sort(numbers)
+		for _, number := range numbers {
+			data := upload.parts[number]
+			result.Part = append(result.Part, s3Part{PartNumber: number, ETag: etag(data), Size: int64(len(data)), LastModified: time.Now().UTC()})
+			result.NextPartNumberMarker = number
+		}
+		writeXML(w, result)
+	case http.MethodPost:
+		var complete struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil || len(complete.Part) == 0 {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		object := []byte{}
+		for i, part := range complete.Part {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || strings.Trim(part.ETag, `"`) != strings.Trim(etag(data), `"`) || (i > 0 && part.PartNumber <= complete.Part[i-1].PartNumber) {
+				s3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if i < len(complete.Part)-1 && len(data) < 5<<20 {
+				s3Error(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			object = append(object, data...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, id)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: s.bucket, Key: key, ETag: etag(object)})
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// startS3 serves a fake bucket, and returns it with the url of a destination under prefix in it
+func startS3(t *testing.T, prefix string) (*fakeS3, *url.URL) {
+	t.Helper()
+	fake := &fakeS3{bucket: "backups", objects: map[string][]byte{}, uploads: map[string]*fakeUpload{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	return fake, &url.URL{
+		Scheme:   "s3",
+		User:     url.UserPassword("access", "secret"),
+		Host:     u.Host,
+		Path:     "/" + fake.bucket + "/" + prefix,
+		RawQuery: "insecure&region=us-east-1",
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake, u := startS3(t, "laptop")
+	fake.objects["other/1500"] = []byte("outside of the prefix")
+	fake.objects["laptop/folder/1600"] = []byte("in a folder under the prefix")
+
+	dest, err := storage.DialS3(u)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dest.Close()
+	testDestination(t, dest)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left", len(fake.uploads))
+	}
+	if _, ok := fake.objects["laptop/1000"]; !ok {
+		t.Fatal("the backup isn't stored under the prefix")
+	}
+}
+
+func TestS3Missing(t *testing.T) {
+	_, u := startS3(t, "")
+	u.Path = "/missing"
+	if _, err := storage.DialS3(u); err == nil {
+		t.Fatal("no error for a bucket which doesn't exist")
+	}
+}
+
+func TestS3Resumable(t *testing.T) {
+	fake, u := startS3(t, "laptop")
+	dest, err := storage.DialS3(u)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dest.Close()
+
+	// Big enough for a full part to be resumed from, and one more to be sent after resuming
+	testResumable(t, dest, 2*storage.S3_PART_SIZE+1000)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left", len(fake.uploads))
+	}
+}
+
+func TestS3Abort(t *testing.T) {
+	fake, u := startS3(t, "")
+	dest, err := storage.DialS3(u)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dest.Close()
+
+	upload, err := dest.CreateResumable("1000")
+	if err != nil {
+		t.Fatalf("create resumable: %v", err)
+	}
+	if _, err := upload.Write(bytes.Repeat([]byte{1}, storage.S3_PART_SIZE+1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := upload.Abort(); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	checkFiles(t, dest)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.uploads) != 0 {
+		t.Fatal("the multipart upload is left after aborting")
+	}
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const SFTP_PORT = "22"
+const sftpBufferSize = 1 << 20 // Bigger writes are sent concurrently
+
+// Private keys tried when none is specified, in order
+var DEFAULT_SSH_KEYS = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Sftp stores the backups in a folder of a remote server
+type Sftp struct {
+	client *sftp.Client
+	conn   *ssh.Client // Only if dialed by DialSftp
+	dir    string
+	host   string
+}
+
+// NewSftp uses an already established ssh connection, which is left open when closing
+func NewSftp(conn *ssh.Client, dir string) (*Sftp, error) {
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.MkdirAll(dir); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Sftp{client: client, dir: dir, host: conn.RemoteAddr().String()}, nil
+}
+
+// DialSftp connects to sftp://user@host[:port]/path. The path is absolute, unless it starts with /~/.
+// The private key and the known hosts are the ones in ~/.ssh, unless the key or known_hosts query values are set
+func DialSftp(u *url.URL) (*Sftp, error) {
+	home, _ := os.UserHomeDir()
+	sshDir := filepath.Join(home, ".ssh")
+
+	user := u.User.Username()
+	if user == "" {
+		return nil, errors.New("missing user in " + u.Redacted())
+	}
+
+	signer, err := loadKey(u.Query().Get("key"), sshDir)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsPath := u.Query().Get("known_hosts")
+	if knownHostsPath == "" {
+		knownHostsPath = filepath.Join(sshDir, "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), SFTP_PORT)
+	}
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dir := u.Path
+	if rest, ok := strings.CutPrefix(dir, "/~"); ok { // Relative to the home of the user
+		dir = strings.TrimPrefix(rest, "/")
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	s, err := NewSftp(conn, dir)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn = conn
+	s.host = u.Host
+	return s, nil
+}
+
+// loadKey reads the private key, or the first default one found in sshDir
+func loadKey(keyPath, sshDir string) (ssh.Signer, error) {
+	candidates := []string{keyPath}
+	if keyPath == "" {
+		candidates = []string{}
+		for _, name := range DEFAULT_SSH_KEYS {
+			candidates = append(candidates, filepath.Join(sshDir, name))
+		}
+	}
+
+	for _, candidate := range candidates {
+		data, err := os.ReadFile(candidate)
+		if errors.Is(err, os.ErrNotExist) && keyPath == "" {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKey(data) // Keys protected by a passphrase aren't supported
+	}
+	return nil, errors.New("no ssh private key found in " + sshDir)
+}
+
+// Create writes to a temporary file, which is renamed once complete
+func (s *Sftp) Create(name string) (Upload, error) {
+	target := path.Join(s.dir, name)
+	file, err := s.client.Create(target + TEMP_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	upload := sftpUpload{Writer: bufio.NewWriterSize(file, sftpBufferSize), file: file, client: s.client}
+	return &sftpTemp{sftpUpload: upload, path: target}, nil
+}
+
+func (s *Sftp) CreateResumable(name string) (ResumableUpload, error) {
+	target := path.Join(s.dir, name)
+	file, err := s.client.Create(target + PARTIAL_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	return newSftpResumable(s.client, file, target, 0), nil
+}
+
+func (s *Sftp) ResumeUpload(name string, offset int64) (ResumableUpload, error) {
+	target := path.Join(s.dir, name)
+	file, err := s.client.OpenFile(target+PARTIAL_SUFFIX, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	if err := resumeAt(file, offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return newSftpResumable(s.client, file, target, offset), nil
+}
+
+func (s *Sftp) Open(name string) (Object, error) {
+	file, err := s.client.Open(path.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &sftpObject{file, info.Size()}, nil
+}
+
+func (s *Sftp) List() ([]Info, error) {
+	entries, err := s.client.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, Info{Name: entry.Name(), Size: entry.Size(), ModTime: entry.ModTime()})
+	}
+	return infos, nil
+}
+
+func (s *Sftp) Remove(name string) error {
+	return s.client.Remove(path.Join(s.dir, name))
+}
+
+// FreeSpace needs the statvfs extension of OpenSSH
+func (s *Sftp) FreeSpace() (int64, error) {
+	stat, err := s.client.StatVFS(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Frsize * stat.Bavail), nil
+}
+
+func (s *Sftp) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+func (s *Sftp) String() string {
+	if path.IsAbs(s.dir) {
+		return "sftp://" + s.host + s.dir
+	}
+	return "sftp://" + s.host + "/~/" + s.dir
+}
+
+type sftpObject struct {
+	*sftp.File
+	size int64
+}
+
+func (o *sftpObject) Size() int64 {
+	return o.size
+}
+
+type sftpUpload struct {
+	*bufio.Writer
+	file   *sftp.File
+	client *sftp.Client
+}
+
+func (u *sftpUpload) Close() error {
+	if err := u.Flush(); err != nil {
+		u.file.Close()
+		return err
+	}
+	return u.file.Close()
+}
+
+func (u *sftpUpload) Abort() error {
+	u.file.Close()
+	return u.client.Remove(u.file.Name())
+}
+
+// Sync waits for the server to acknowledge every write, and asks it to fsync the file, if it supports the extension of OpenSSH
+func (u *sftpUpload) Sync() error {
+	if err := u.Flush(); err != nil {
+		return err
+	}
+	var status *sftp.StatusError
+	if err := u.file.Sync(); err != nil && !(errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// sftpTemp writes to the temporary file of a backup being created
+type sftpTemp struct {
+	sftpUpload
+	path string
+}
+
+func (u *sftpTemp) Close() error {
+	if err := u.Sync(); err != nil {
+		u.file.Close()
+		return err
+	}
+	if err := u.sftpUpload.Close(); err != nil {
+		return err
+	}
+	return u.client.PosixRename(u.path+TEMP_SUFFIX, u.path)
+}
+
+// sftpResumable writes to the partial file, which is renamed once complete
+type sftpResumable struct {
+	sftpUpload
+	path    string
+	written int64
+}
+
+func newSftpResumable(client *sftp.Client, file *sftp.File, path string, written int64) *sftpResumable {
+	upload := sftpUpload{Writer: bufio.NewWriterSize(file, sftpBufferSize), file: file, client: client}
+	return &sftpResumable{sftpUpload: upload, path: path, written: written}
+}
+
+func (u *sftpResumable) Write(p []byte) (int, error) {
+	n, err := u.sftpUpload.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+// Sync waits for the server to acknowledge every write
+func (u *sftpResumable) Sync() (int64, error) {
+	if err := u.Flush(); err != nil {
+		return 0, err
+	}
+	return u.written, nil
+}
+
+func (u *sftpResumable) Close() error {
+	if err := u.sftpUpload.Close(); err != nil {
+		return err
+	}
+	return u.client.PosixRename(u.path+PARTIAL_SUFFIX, u.path)
+}
+
+func (u *sftpResumable) Pause() error {
+	u.Flush()
+	return u.file.Close()
+}
@@ -0,0 +1,205 @@
+package storage_test
+
+import (
+	"backupusb/backups"
+	"backupusb/storage"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSftp serves sftp over ssh in the same process, on a random local port. Only the user key written in dir is accepted,
+// and dir also gets a known_hosts file with the key of the server. Returns the url of the folder dest in dir
+func startSftp(t *testing.T, dir string) *url.URL {
+	t.Helper()
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	userSigner, err := ssh.NewSignerFromKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userSigner.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSftp(conn, config)
+		}
+	}()
+
+	block, err := ssh.MarshalPrivateKey(userKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	knownHosts := fmt.Sprintf("[%s]:%s %s", host, port, ssh.MarshalAuthorizedKey(hostSigner.PublicKey()))
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHostsPath, []byte(knownHosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &url.URL{
+		Scheme:   "sftp",
+		User:     url.User("backup"),
+		Host:     listener.Addr().String(),
+		Path:     filepath.ToSlash(filepath.Join(dir, "dest")),
+		RawQuery: url.Values{"key": {keyPath}, "known_hosts": {knownHostsPath}}.Encode(),
+	}
+}
+
+// serveSftp handles a single ssh connection, accepting only the sftp subsystem
+func serveSftp(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				if err := server.Serve(); err != nil && err != io.EOF {
+					server.Close()
+					return
+				}
+				server.Close()
+			}
+		}()
+	}
+}
+
+func dialSftp(t *testing.T) (*storage.Sftp, string) {
+	t.Helper()
+	dir := t.TempDir()
+	dest, err := storage.DialSftp(startSftp(t, dir))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { dest.Close() })
+	return dest, filepath.Join(dir, "dest")
+}
+
+func TestSftp(t *testing.T) {
+	dest, dir := dialSftp(t)
+	testDestination(t, dest)
+
+	// The temporary file only gets the name of the backup once closed
+	u, err := dest.Create("5000")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	u.Write([]byte("content"))
+	if _, err := os.Stat(filepath.Join(dir, "5000"+storage.TEMP_SUFFIX)); err != nil {
+		t.Fatalf("no temporary file while uploading: %v", err)
+	}
+	if err := u.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "5000"+storage.TEMP_SUFFIX)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the temporary file is left after closing: %v", err)
+	}
+	checkFiles(t, dest, "1000", "5000")
+
+	testResumable(t, dest, 5<<20+77)
+}
+
+func TestSftpFreeSpace(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("the sftp server only supports statvfs on linux and macos")
+	}
+	dest, _ := dialSftp(t)
+	free, err := dest.FreeSpace()
+	if err != nil {
+		t.Fatalf("free space: %v", err)
+	}
+	if free <= 0 {
+		t.Fatalf("free space %d", free)
+	}
+}
+
+func TestSftpRetention(t *testing.T) {
+	dest, _ := dialSftp(t)
+	for _, name := range []string{"1000", "2000", "3000", "4000"} {
+		upload(t, dest, name, []byte(backups.MAGIC+"backup "+name))
+	}
+	upload(t, dest, "notes.txt", []byte(backups.MAGIC)) // Not a backup name, never touched
+	upload(t, dest, "5000", []byte("not a backup"))     // Not created by the program
+	upload(t, dest, "100", testData(100))               // Named like a backup, but without the magic: from before the preamble
+
+	removals, skipped, err := backups.Prune(dest, backups.Retention{Last: 2}, false)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(removals) != 2 || removals[0].Name != "1000" || removals[1].Name != "2000" {
+		t.Fatalf("removed %v, want 1000 and 2000", removals)
+	}
+	for _, removal := range removals {
+		if removal.Err != nil {
+			t.Fatalf("remove %s: %v", removal.Name, removal.Err)
+		}
+	}
+	if len(skipped) != 1 || skipped[0].Name != "100" {
+		t.Fatalf("skipped %v, want the legacy backup 100", skipped)
+	}
+	checkFiles(t, dest, "3000", "4000", "5000", "100", "notes.txt")
+
+	// Unless asked to include them
+	removals, skipped, err = backups.Prune(dest, backups.Retention{Last: 2, Legacy: true}, false)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if len(removals) != 1 || removals[0].Name != "100" || removals[0].Err != nil || len(skipped) != 0 {
+		t.Fatalf("removed %v and skipped %v, want 100 removed", removals, skipped)
+	}
+	checkFiles(t, dest, "3000", "4000", "5000", "notes.txt")
+}
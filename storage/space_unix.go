@@ -0,0 +1,14 @@
+//go:build unix
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the space available to the user in the folder
+func (l *Local) FreeSpace() (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(l.Dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package storage
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the space available to the user in the folder
+func (l *Local) FreeSpace() (int64, error) {
+	dir, err := windows.UTF16PtrFromString(l.Dir)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Destination is a place where the backups are stored, either a local folder or a remote server
+type Destination interface {
+	Create(name string) (Upload, error)
+	Open(name string) (Object, error)
+	List() ([]Info, error) // Every file in the destination, not only the backups
+	Remove(name string) error
+	Close() error
+	String() string // Where it is, without any credentials
+}
+
+// Upload is a backup being written. It's only kept once closed (under its name, never a truncated file), and removed if aborted
+type Upload interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Object is a backup being read. Reads can happen concurrently, and from any position
+type Object interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Syncer is implemented by the uploads which can make the destination persist what has been written so far (fsync)
+type Syncer interface {
+	Sync() error
+}
+
+// TEMP_SUFFIX marks the backups being created, which are only renamed once complete. Unlike the partial uploads they can't be resumed
+const TEMP_SUFFIX = ".tmp"
+
+// PARTIAL_SUFFIX marks the files of the resumable uploads which haven't been completed yet
+const PARTIAL_SUFFIX = ".partial"
+
+// Resumable is implemented by the destinations which can keep an interrupted upload, and continue it later
+type Resumable interface {
+	CreateResumable(name string) (ResumableUpload, error)            // The upload is only visible as name once closed
+	ResumeUpload(name string, offset int64) (ResumableUpload, error) // Continues after the first offset bytes, as returned by Sync
+}
+
+// ResumableUpload keeps what it has stored when paused (or when the program is interrupted), and only removes it if aborted
+type ResumableUpload interface {
+	Upload
+	Sync() (int64, error) // Stores what has been written so far, returning how much of it can be resumed from
+	Pause() error
+}
+
+// FreeSpacer is implemented by the destinations which can tell how much space is left
+type FreeSpacer interface {
+	FreeSpace() (int64, error) // In bytes
+}
+
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Open connects to the destination, which can be a local folder, or an url:
+//   - sftp://user@host[:port]/path[?key=<private key file>&known_hosts=<file>]
+//   - s3://[access:secret@]host[:port]/bucket[/prefix][?region=<region>&insecure]
+//   - webdav://[user:password@]host[:port]/path, or webdavs:// over https
+func Open(dest string) (Destination, error) {
+	if u, ok := remoteURL(dest); ok {
+		switch u.Scheme {
+		case "sftp":
+			return DialSftp(u)
+		case "s3":
+			return DialS3(u)
+		case "webdav", "webdavs":
+			return DialWebdav(u)
+		}
+	}
+	return NewLocal(dest)
+}
+
+// remoteURL parses the location, if it refers to a remote destination
+func remoteURL(location string) (*url.URL, bool) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, false
+	}
+	switch u.Scheme {
+	case "sftp", "s3", "webdav", "webdavs":
+		return u, true
+	}
+	return nil, false
+}
+
+// OpenFile opens a single backup, either a local file or an url of one of the remote destinations
+func OpenFile(location string) (Object, error) {
+	u, ok := remoteURL(location)
+	if !ok {
+		return openLocal(location)
+	}
+
+	// Connect to the folder containing it
+	dir, name := path.Split(u.Path)
+	u.Path = dir
+	dest, err := Open(u.String())
+	if err != nil {
+		return nil, err
+	}
+	object, err := dest.Open(name)
+	if err != nil {
+		dest.Close()
+		return nil, err
+	}
+	return &remoteObject{object, dest}, nil
+}
+
+// Name returns the file name of the backup at location, without the folder (or the url) it's in
+func Name(location string) string {
+	if u, ok := remoteURL(location); ok {
+		return path.Base(u.Path)
+	}
+	return filepath.Base(location)
+}
+
+// Redact hides the password of the url, if there is one, so that the location can be printed
+func Redact(location string) string {
+	if u, ok := remoteURL(location); ok {
+		return u.Redacted()
+	}
+	return location
+}
+
+// remoteObject also closes the connection to its destination
+type remoteObject struct {
+	Object
+	dest Destination
+}
+
+func (o *remoteObject) Close() error {
+	err := o.Object.Close()
+	o.dest.Close()
+	return err
+}
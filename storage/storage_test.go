@@ -0,0 +1,171 @@
+package storage_test
+
+import (
+	"backupusb/storage"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"testing"
+)
+
+// upload stores data under name with Create, failing the test on any error
+func upload(t *testing.T, dest storage.Destination, name string, data []byte) {
+	t.Helper()
+	u, err := dest.Create(name)
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	if _, err := u.Write(data); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	if err := u.Close(); err != nil {
+		t.Fatalf("close %s: %v", name, err)
+	}
+}
+
+// names lists the names of the files in the destination, sorted
+func names(t *testing.T, dest storage.Destination) []string {
+	t.Helper()
+	infos, err := dest.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// checkFiles fails the test unless the destination contains exactly the files
+func checkFiles(t *testing.T, dest storage.Destination, want ...string) {
+	t.Helper()
+	slices.Sort(want)
+	if got := names(t, dest); !slices.Equal(got, want) {
+		t.Fatalf("files %v, want %v", got, want)
+	}
+}
+
+// checkContent reads the whole file, and then a part of it from the middle
+func checkContent(t *testing.T, dest storage.Destination, name string, want []byte) {
+	t.Helper()
+	object, err := dest.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer object.Close()
+
+	if object.Size() != int64(len(want)) {
+		t.Fatalf("size of %s %d, want %d", name, object.Size(), len(want))
+	}
+	got, err := io.ReadAll(io.NewSectionReader(object, 0, object.Size()))
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content of %s doesn't match", name)
+	}
+
+	if len(want) < 10 {
+		return
+	}
+	part := make([]byte, len(want)/3)
+	if _, err := object.ReadAt(part, int64(len(want)/2)); err != nil && err != io.EOF {
+		t.Fatalf("read at %s: %v", name, err)
+	}
+	if !bytes.Equal(part, want[len(want)/2:len(want)/2+len(part)]) {
+		t.Fatalf("content of %s at offset %d doesn't match", name, len(want)/2)
+	}
+}
+
+// testData returns size bytes which don't repeat in any short period
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// testDestination goes through what every destination must support: the uploads, aborted or completed, and reading and removing the files
+func testDestination(t *testing.T, dest storage.Destination) {
+	data := testData(3<<20 + 123)
+	upload(t, dest, "1000", data)
+	upload(t, dest, "2000", []byte("small"))
+	checkFiles(t, dest, "1000", "2000")
+	checkContent(t, dest, "1000", data)
+	checkContent(t, dest, "2000", []byte("small"))
+
+	// Nothing is visible under the name until the upload is closed, and nothing is left once aborted
+	u, err := dest.Create("3000")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := u.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := dest.Open("3000"); err == nil {
+		t.Fatal("the upload is visible before being closed")
+	}
+	if err := u.Abort(); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	checkFiles(t, dest, "1000", "2000")
+
+	if err := dest.Remove("2000"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	checkFiles(t, dest, "1000")
+	if err := dest.Remove("2000"); err != nil && !errors.Is(err, fs.ErrNotExist) { // S3 doesn't tell
+		t.Fatalf("removing a missing file returned %v, want fs.ErrNotExist", err)
+	}
+}
+
+// testResumable uploads a file of size bytes in two sessions, pausing in between
+func testResumable(t *testing.T, dest storage.Destination, size int) {
+	resumable, ok := dest.(storage.Resumable)
+	if !ok {
+		t.Fatalf("%s isn't resumable", dest)
+	}
+	data := testData(size)
+	half := len(data) / 2
+
+	u, err := resumable.CreateResumable("4000")
+	if err != nil {
+		t.Fatalf("create resumable: %v", err)
+	}
+	if _, err := u.Write(data[:half]); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	offset, err := u.Sync()
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if offset < 0 || offset > int64(half) {
+		t.Fatalf("synced %d bytes out of %d", offset, half)
+	}
+	if err := u.Pause(); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	if slices.Contains(names(t, dest), "4000") {
+		t.Fatal("the paused upload is visible")
+	}
+
+	u, err = resumable.ResumeUpload("4000", offset)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if _, err := u.Write(data[offset:]); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := u.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	checkContent(t, dest, "4000", data)
+	if err := dest.Remove("4000"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responses kept open by an object being read, each of them continued by the next read at its offset
+const webdavStreams = 8
+
+// Removals of an aborted upload while the server still keeps it locked, 100ms apart
+const webdavAbortRetries = 20
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/><quota-available-bytes/></prop></propfind>`
+
+// Webdav stores the backups in a folder of a WebDAV server (Nextcloud, ownCloud, Apache...)
+type Webdav struct {
+	client   *http.Client
+	base     *url.URL // The folder, ending with a /, without credentials
+	user     string
+	password string
+}
+
+// NewWebdav uses the folder at base (an http or https url), creating it if needed. The credentials are sent with basic auth, unless empty
+func NewWebdav(client *http.Client, base *url.URL, user, password string) (*Webdav, error) {
+	base = base.JoinPath("/")
+	w := &Webdav{client: client, base: base, user: user, password: password}
+	if _, err := w.stat(base.String()); errors.Is(err, fs.ErrNotExist) {
+		if err := w.mkdirAll(base); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// DialWebdav connects to webdav://[user:password@]host[:port]/path, or webdavs:// for https
+func DialWebdav(u *url.URL) (*Webdav, error) {
+	base := &url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	password, _ := u.User.Password()
+	return NewWebdav(&http.Client{}, base, u.User.Username(), password)
+}
+
+// webdavError is a request refused by the server
+type webdavError struct {
+	method string
+	target string
+	code   int
+	status string
+}
+
+func (e *webdavError) Error() string {
+	return e.method + " " + e.target + ": " + e.status
+}
+
+func (e *webdavError) Is(target error) bool {
+	return target == fs.ErrNotExist && e.code == http.StatusNotFound
+}
+
+// do sends the request, returning an error unless it succeeded
+func (w *Webdav) do(method, target string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &webdavError{method: method, target: target, code: resp.StatusCode, status: resp.Status}
+	}
+	return resp, nil
+}
+
+func (w *Webdav) url(name string) string {
+	return w.base.JoinPath(name).String()
+}
+
+// mkdirAll creates the folder, and its parents if they are missing
+func (w *Webdav) mkdirAll(dir *url.URL) error {
+	resp, err := w.do("MKCOL", dir.String(), nil, nil)
+	var status *webdavError
+	if errors.As(err, &status) && status.code == http.StatusConflict && dir.Path != "/" { // The parent is missing
+		parent := *dir
+		parent.Path = path.Dir(strings.TrimSuffix(dir.Path, "/")) + "/"
+		if err := w.mkdirAll(&parent); err != nil {
+			return err
+		}
+		resp, err = w.do("MKCOL", dir.String(), nil, nil)
+	}
+	if errors.As(err, &status) && status.code == http.StatusMethodNotAllowed { // Already exists
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type webdavEntry struct {
+	Info
+	collection bool
+	available  int64 // Free space, -1 if unknown
+}
+
+// multistatus is the answer to PROPFIND
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				Available     *int64 `xml:"quota-available-bytes"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// propfind returns the entry at target, and the ones it contains if depth is 1
+func (w *Webdav) propfind(target, depth string) ([]webdavEntry, error) {
+	resp, err := w.do("PROPFIND", target, strings.NewReader(propfindBody), http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := multistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %w", target, err)
+	}
+
+	entries := make([]webdavEntry, 0, len(result.Responses))
+	for _, response := range result.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		entry := webdavEntry{Info: Info{Name: path.Base(strings.TrimSuffix(href.Path, "/"))}, available: -1}
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") { // Properties which the server doesn't have
+				continue
+			}
+			prop := propstat.Prop
+			entry.collection = entry.collection || prop.ResourceType.Collection != nil
+			entry.Size = max(entry.Size, prop.ContentLength)
+			if modTime, err := http.ParseTime(prop.LastModified); err == nil {
+				entry.ModTime = modTime
+			}
+			if prop.Available != nil && *prop.Available >= 0 { // Negative values mean that the quota is unknown or unlimited
+				entry.available = *prop.Available
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (w *Webdav) stat(target string) (webdavEntry, error) {
+	entries, err := w.propfind(target, "0")
+	if err != nil {
+		return webdavEntry{}, err
+	}
+	if len(entries) != 1 {
+		return webdavEntry{}, errors.New("PROPFIND " + target + ": unexpected response")
+	}
+	return entries[0], nil
+}
+
+// Create streams the backup as the body of a single request, since its size isn't known in advance.
+// It's sent to a temporary file, which is moved once complete
+func (w *Webdav) Create(name string) (Upload, error) {
+	reader, writer := io.Pipe()
+	upload := &webdavUpload{pipe: writer, done: make(chan error, 1), dest: w, name: name}
+
+	go func() {
+		resp, err := w.do(http.MethodPut, w.url(name+TEMP_SUFFIX), reader, http.Header{"Content-Type": {"application/octet-stream"}})
+		if err == nil {
+			resp.Body.Close()
+		}
+		reader.CloseWithError(err) // Unblocks the writer if the upload failed
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+func (w *Webdav) Open(name string) (Object, error) {
+	entry, err := w.stat(w.url(name))
+	if err != nil {
+		return nil, err
+	}
+	if entry.collection {
+		return nil, errors.New(name + " is a folder")
+	}
+	return &webdavObject{dest: w, name: name, size: entry.Size}, nil
+}
+
+// List only returns the files, not the folders
+func (w *Webdav) List() ([]Info, error) {
+	entries, err := w.propfind(w.base.String(), "1")
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.collection { // The folder itself is a collection too
+			infos = append(infos, entry.Info)
+		}
+	}
+	return infos, nil
+}
+
+func (w *Webdav) Remove(name string) error {
+	resp, err := w.do(http.MethodDelete, w.url(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// FreeSpace is the quota left, if the server reports it
+func (w *Webdav) FreeSpace() (int64, error) {
+	entry, err := w.stat(w.base.String())
+	if err != nil {
+		return 0, err
+	}
+	if entry.available == -1 {
+		return 0, errors.New("the server doesn't report its free space")
+	}
+	return entry.available, nil
+}
+
+func (w *Webdav) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+func (w *Webdav) String() string {
+	return "webdav" + strings.TrimPrefix(w.base.String(), "http")
+}
+
+// webdavObject reads the file with range requests. Sequential reads continue the same response, instead of sending a new request each time
+type webdavObject struct {
+	dest    *Webdav
+	name    string
+	size    int64
+	mu      sync.Mutex
+	streams []*webdavStream // Idle, the oldest first
+}
+
+type webdavStream struct {
+	body   io.ReadCloser
+	offset int64
+}
+
+func (o *webdavObject) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	stream, err := o.stream(off)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(stream.body, p[:min(int64(len(p)), o.size-off)])
+	stream.offset += int64(n)
+	if err != nil {
+		stream.body.Close()
+		return n, err
+	}
+
+	o.mu.Lock()
+	o.streams = append(o.streams, stream)
+	if len(o.streams) > webdavStreams {
+		o.streams[0].body.Close()
+		o.streams = o.streams[1:]
+	}
+	o.mu.Unlock()
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// stream takes the idle response at off, or requests the rest of the file from there
+func (o *webdavObject) stream(off int64) (*webdavStream, error) {
+	o.mu.Lock()
+	for i, stream := range o.streams {
+		if stream.offset == off {
+			o.streams = append(o.streams[:i], o.streams[i+1:]...)
+			o.mu.Unlock()
+			return stream, nil
+		}
+	}
+	o.mu.Unlock()
+
+	resp, err := o.dest.do(http.MethodGet, o.dest.url(o.name), nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-", off)}})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && off > 0 {
+		resp.Body.Close()
+		return nil, errors.New("the server doesn't support range requests")
+	}
+	return &webdavStream{body: resp.Body, offset: off}, nil
+}
+
+func (o *webdavObject) Size() int64 {
+	return o.size
+}
+
+func (o *webdavObject) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, stream := range o.streams {
+		stream.body.Close()
+	}
+	o.streams = nil
+	return nil
+}
+
+type webdavUpload struct {
+	pipe *io.PipeWriter
+	done chan error
+	dest *Webdav
+	name string
+}
+
+func (u *webdavUpload) Write(p []byte) (int, error) {
+	return u.pipe.Write(p)
+}
+
+// Close waits for the server to store the whole file, and moves it in place
+func (u *webdavUpload) Close() error {
+	u.pipe.Close()
+	if err := <-u.done; err != nil {
+		return err
+	}
+	resp, err := u.dest.do("MOVE", u.dest.url(u.name+TEMP_SUFFIX), nil, http.Header{
+		"Destination": {u.dest.url(u.name)},
+		"Overwrite":   {"T"},
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Abort interrupts the request, and removes what the server may have kept of it. The server can keep the file locked
+// until it notices the interruption, so the removal is retried for a while (the next backup removes it otherwise)
+func (u *webdavUpload) Abort() error {
+	u.pipe.CloseWithError(errUploadAborted)
+	<-u.done
+	for range webdavAbortRetries {
+		var status *webdavError
+		if err := u.dest.Remove(u.name + TEMP_SUFFIX); !errors.As(err, &status) || status.code != http.StatusLocked {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
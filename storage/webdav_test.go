@@ -0,0 +1,142 @@
+package storage_test
+
+import (
+	"backupusb/storage"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// startWebdav serves an in-memory WebDAV server, counting the requests sent for each method
+func startWebdav(t *testing.T) (webdav.FileSystem, *url.URL, map[string]*atomic.Int64) {
+	t.Helper()
+	fs := webdav.NewMemFS()
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	requests := map[string]*atomic.Int64{}
+	for _, method := range []string{"GET", "PUT", "MOVE", "MKCOL", "DELETE", "PROPFIND"} {
+		requests[method] = &atomic.Int64{}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count, ok := requests[r.Method]; ok {
+			count.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	u.Scheme = "webdav"
+	return fs, u, requests
+}
+
+func TestWebdav(t *testing.T) {
+	fs, u, requests := startWebdav(t)
+	u.Path = "/backups/laptop"
+	dest, err := storage.DialWebdav(u)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dest.Close()
+
+	// Both folders are created, the parent first since MKCOL fails with 409 while it's missing
+	if info, err := fs.Stat(context.Background(), "/backups/laptop"); err != nil || !info.IsDir() {
+		t.Fatalf("the folder hasn't been created: %v", err)
+	}
+	if n := requests["MKCOL"].Load(); n != 3 {
+		t.Fatalf("%d MKCOL requests, want 3", n)
+	}
+
+	// Folders aren't listed, only the files
+	if err := fs.Mkdir(context.Background(), "/backups/laptop/folder", 0700); err != nil {
+		t.Fatal(err)
+	}
+	testDestination(t, dest)
+	if n := requests["MOVE"].Load(); n != 2 {
+		t.Fatalf("%d MOVE requests, want one for each upload", n)
+	}
+
+	// Opening the folder again doesn't create anything
+	again, err := storage.DialWebdav(u)
+	if err != nil {
+		t.Fatalf("dial again: %v", err)
+	}
+	again.Close()
+	if n := requests["MKCOL"].Load(); n != 3 {
+		t.Fatalf("%d MKCOL requests after opening the folder again, want 3", n)
+	}
+}
+
+func TestWebdavRanges(t *testing.T) {
+	_, u, requests := startWebdav(t)
+	dest, err := storage.DialWebdav(u)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dest.Close()
+
+	data := testData(1 << 20)
+	upload(t, dest, "1000", data)
+	object, err := dest.Open("1000")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer object.Close()
+
+	// Sequential reads continue the same response
+	requests["GET"].Store(0)
+	got, err := io.ReadAll(io.NewSectionReader(object, 0, object.Size()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Fatal("content doesn't match")
+	}
+	if n := requests["GET"].Load(); n != 1 {
+		t.Fatalf("%d GET requests for a sequential read, want 1", n)
+	}
+
+	// Reading from another offset needs a new range request, which is then reused by the next read at its end
+	part := make([]byte, 1000)
+	for _, off := range []int64{5000, 6000, 7000} {
+		if _, err := object.ReadAt(part, off); err != nil {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+		if string(part) != string(data[off:off+1000]) {
+			t.Fatalf("content at %d doesn't match", off)
+		}
+	}
+	if n := requests["GET"].Load(); n != 2 {
+		t.Fatalf("%d GET requests, want 2", n)
+	}
+
+	// The last bytes, then past the end
+	n, err := object.ReadAt(part, int64(len(data)-10))
+	if n != 10 || err != io.EOF {
+		t.Fatalf("read of the end returned %d, %v, want 10, EOF", n, err)
+	}
+	if _, err := object.ReadAt(part, int64(len(data))); err != io.EOF {
+		t.Fatalf("read past the end returned %v, want EOF", err)
+	}
+}
+
+func TestWebdavFreeSpace(t *testing.T) {
+	_, u, _ := startWebdav(t)
+	dest, err := storage.DialWebdav(u)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer dest.Close()
+
+	// golang.org/x/net/webdav doesn't have quotas
+	if _, err := dest.FreeSpace(); err == nil || !strings.Contains(err.Error(), "doesn't report") {
+		t.Fatalf("free space returned %v, want an error telling it's not reported", err)
+	}
+}